@@ -0,0 +1,155 @@
+package main
+
+// Commands read from standard input while daghead runs.
+
+import (
+	"bufio"
+	"github.com/kb2ma/daghead/internal/log"
+	"github.com/kb2ma/daghead/internal/router"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Reads commands, one per line, until the end of input. Commands:
+
+  repair [instance]                  Global repair for the RPL Instance; default
+                                     instance 0
+  project <ingress> <egress> [disjoint]
+                                     Projects a route between motes, in the
+                                     default instance
+  unproject <track>                  Removes a projected route
+  tracks                             Lists projected routes
+  routes                             Lists the links in the routing table for the
+                                     default instance, as static or dynamic, and
+                                     stale if restored and not yet refreshed
+  pending                            Lists the links from DAOs waiting for their
+                                     parent, for each instance
+  help                               Lists the commands
+*/
+func readConsole(input io.Reader) {
+	scanner := bufio.NewScanner(input)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "repair":
+			instanceId := router.DEFAULT_INSTANCE_ID
+			if len(fields) > 1 {
+				id, err := strconv.ParseUint(fields[1], 10, 8)
+				if err != nil {
+					log.Printf(log.ERROR, "Invalid instance %s\n", fields[1])
+					continue
+				}
+				instanceId = byte(id)
+			}
+			r := router.FindRouter(instanceId, nil)
+			if r == nil {
+				log.Printf(log.ERROR, "Instance %d not known\n", instanceId)
+				continue
+			}
+			if err := globalRepair(r); err != nil {
+				log.Println(log.ERROR, err)
+			}
+		case "project":
+			if (len(fields) < 3) || ((len(fields) > 3) && (fields[3] != "disjoint")) {
+				log.Println(log.ERROR, "Usage: project <ingress> <egress> [disjoint]")
+				continue
+			}
+			r := defaultRouter()
+			if r == nil {
+				continue
+			}
+			ingressId, err := parseMoteId(fields[1])
+			if err != nil {
+				log.Println(log.ERROR, err)
+				continue
+			}
+			egressId, err := parseMoteId(fields[2])
+			if err != nil {
+				log.Println(log.ERROR, err)
+				continue
+			}
+			track, err := projectRoute(r, ingressId, egressId, len(fields) > 3)
+			if err != nil {
+				log.Println(log.ERROR, err)
+				continue
+			}
+			log.Printf(log.INFO, "Sent P-DAO for %v\n", track)
+		case "unproject":
+			if len(fields) < 2 {
+				log.Println(log.ERROR, "Usage: unproject <track>")
+				continue
+			}
+			trackId, err := strconv.ParseUint(fields[1], 10, 8)
+			if err != nil {
+				log.Printf(log.ERROR, "Invalid Track %s\n", fields[1])
+				continue
+			}
+			if r := defaultRouter(); r != nil {
+				if err := unprojectRoute(r, byte(trackId)); err != nil {
+					log.Println(log.ERROR, err)
+				}
+			}
+		case "tracks":
+			if r := defaultRouter(); r != nil {
+				logTracks(r)
+			}
+		case "routes":
+			if r := defaultRouter(); r != nil {
+				logRoutes(r)
+			}
+		case "pending":
+			logPendingLinks()
+		case "help":
+			log.Println(log.INFO, "Commands: repair [instance], project <ingress> <egress> " +
+			                      "[disjoint], unproject <track>, tracks, routes, pending, help")
+		default:
+			log.Printf(log.ERROR, "Unknown command %s\n", fields[0])
+		}
+	}
+}
+
+// Returns the router for the default RPL Instance, or nil and logs if not known
+func defaultRouter() *router.Router {
+	r := router.DefaultRouter()
+	if r == nil {
+		log.Printf(log.ERROR, "Instance %d not known\n", router.DEFAULT_INSTANCE_ID)
+	}
+	return r
+}
+
+// Logs the links to parents for each node in the routing table
+func logRoutes(r *router.Router) {
+	for _, node := range r.Snapshot().Nodes {
+		for _, link := range node.Parents {
+			origin := "dynamic"
+			if link.Static {
+				origin = "static"
+			} else if link.Stale {
+				origin = "dynamic, stale"
+			}
+			log.Printf(log.INFO, "[% X] -> [% X] %s\n", link.ParentId, node.Id, origin)
+		}
+	}
+}
+
+// Logs the links waiting for their parent, for each router
+func logPendingLinks() {
+	count := 0
+	for _, r := range router.Routers() {
+		for _, link := range r.PendingLinks() {
+			log.Printf(log.INFO, "[% X] -> [% X] instance %d, waiting %v\n", link.ParentId,
+			           link.ChildId, r.Key().InstanceId,
+			           time.Since(link.Received).Round(time.Second))
+			count++
+		}
+	}
+	if count == 0 {
+		log.Println(log.INFO, "No pending links")
+	}
+}
@@ -7,6 +7,8 @@ Reads incoming data from root mote, and performs routine management.
   * Sets the root mote as DODAG root. Assumes root mote is not already DODAG root.
     Presently avoids use of Constrained Join Protocol for network motes by using a
     static network key hardcoded into mote firmware.
+  * Triggers a global repair of the DODAG with the 'repair' command on standard
+    input, or on repeated routing loops.
 
 Since RPL operates in non-storing mode, reads ICMPv6 RPL messages to maintain a
 routing table for the network motes.
@@ -14,30 +16,102 @@ routing table for the network motes.
 package main
 
 import (
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"github.com/kb2ma/daghead/internal/log"
+	"github.com/kb2ma/daghead/internal/router"
 	"github.com/mikepb/go-serial"
 	toml "github.com/pelletier/go-toml"
-	"github.com/snksoft/crc"
+	"os"
+	"strings"
 	"sync"
 	"time"
 )
 
-func setDagRoot(wg *sync.WaitGroup, port *serial.Port) {
+func setDagRoot(wg *sync.WaitGroup) {
 	defer wg.Done()
-	// Slice [12:28] (16 bytes) should be generated randomly; requires random seed also
-	data := [31]byte{ 0x7E, 'R', 'T', 0xBB, 0XBB, 0, 0, 0, 0, 0, 0, 0x1, 0x15, 0x38,
-					 0xb6, 0x9a, 0x00, 0xbd, 0xa9, 0x17, 0x14, 0x50, 0x1c, 0xf6,
-					 0x67, 0x76, 0x62, 0xc1, 0, 0, 0x7E }
-	hash := crc.CalculateCRC(crc.X25, data[1:28])
-	data[28] = byte(hash & 0xFF)
-	data[29] = byte((hash & 0xFF00) >> 8)
-	log.Printf(log.INFO, "setDagRoot % X\n", data)
+	// Slice [11:27] (16 bytes) should be generated randomly; requires random seed also
+	content := []byte{ SERFRAME_PC2MOTE_SETDAGROOT, SERFRAME_ACTION_TOGGLE, 0xBB, 0XBB,
+	                   0, 0, 0, 0, 0, 0, 0x1, 0x15, 0x38, 0xb6, 0x9a, 0x00, 0xbd, 0xa9,
+	                   0x17, 0x14, 0x50, 0x1c, 0xf6, 0x67, 0x76, 0x62, 0xc1 }
+	log.Printf(log.INFO, "setDagRoot % X\n", content)
 
-	_, err := port.Write(data[:])
-	if err != nil {
+	if err := writeFrame(content); err != nil {
 		log.Panic(err)
 	}
-	//log.Printf("hash [%X] [%X]\n", hash & 0xFF, (hash & 0xFF00) >> 8)
+}
+
+/*
+Reads a list of mote IDs from config, each an EUI-64 string of 16 hex digits.
+Separators ':' and '-' between bytes are ignored.
+*/
+func readMoteIds(value interface{}) ([][]byte, error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, errors.New("mote ID list is not an array")
+	}
+	ids := make([][]byte, 0, len(list))
+	for _, item := range list {
+		text, ok := item.(string)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("mote ID %v is not a string", item))
+		}
+		id, err := parseMoteId(text)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+/*
+Reads static routes from the [routes] config, as arrays of mote IDs from parent
+down to child, with "root" for the root mote. Each of links has two IDs, and
+each of paths at least two. Returns the static links.
+*/
+func readStaticRoutes(links interface{}, paths interface{}) ([]router.StaticLink, error) {
+	var static []router.StaticLink
+	for n, routes := range []interface{}{links, paths} {
+		isLinks := (n == 0)
+		list, ok := routes.([]interface{})
+		if !ok {
+			return nil, errors.New("static route list is not an array")
+		}
+		for _, item := range list {
+			route, ok := item.([]interface{})
+			if !ok || (len(route) < 2) || (isLinks && (len(route) != 2)) {
+				return nil, errors.New(fmt.Sprintf("invalid static route %v", item))
+			}
+			path := make([][]byte, len(route))
+			for i, hop := range route {
+				text, ok := hop.(string)
+				if !ok {
+					return nil, errors.New(fmt.Sprintf("mote ID %v is not a string", hop))
+				}
+				if (i == 0) && (text == "root") {
+					continue
+				}
+				id, err := parseMoteId(text)
+				if err != nil {
+					return nil, err
+				}
+				path[i] = id
+			}
+			static = append(static, router.StaticPath(path)...)
+		}
+	}
+	return static, nil
+}
+
+// Reads a mote ID as 8 bytes of hex, which may be separated by ':' or '-'
+func parseMoteId(text string) ([]byte, error) {
+	id, err := hex.DecodeString(strings.NewReplacer(":", "", "-", "").Replace(text))
+	if (err != nil) || (len(id) != 8) {
+		return nil, errors.New(fmt.Sprintf("invalid mote ID %s", text))
+	}
+	return id, nil
 }
 
 func main() {
@@ -59,6 +133,62 @@ func main() {
 	}
 	log.Println(log.INFO, "Starting daghead")
 
+	// read routing table config; lifetime unit may be updated later from a DIO
+	lifetimeUnit := config.GetDefault("router.lifetime_unit",
+	                                  int64(router.DEFAULT_LIFETIME_UNIT)).(int64)
+	router.SetLifetimeUnit(int(lifetimeUnit))
+	sweepInterval := config.GetDefault("router.sweep_interval", int64(60)).(int64)
+	pendingTimeout := config.GetDefault("router.pending_timeout",
+	                                    int64(router.DEFAULT_PENDING_TIMEOUT.Seconds())).(int64)
+	router.SetPendingTimeout(time.Duration(pendingTimeout) * time.Second)
+	maxPathLength := config.GetDefault("router.max_path_length",
+	                                   int64(router.DEFAULT_MAX_PATH_LENGTH)).(int64)
+	router.SetMaxPathLength(int(maxPathLength))
+	linkErrorLimit := config.GetDefault("router.link_error_limit",
+	                                    int64(router.DEFAULT_LINK_ERROR_LIMIT)).(int64)
+	router.SetLinkErrorLimit(int(linkErrorLimit))
+	repairLoopLimit := config.GetDefault("router.repair_loop_limit",
+	                                     int64(DEFAULT_REPAIR_LOOP_LIMIT)).(int64)
+	repairWindow := config.GetDefault("router.repair_window",
+	                                  int64(DEFAULT_REPAIR_WINDOW.Seconds())).(int64)
+	loopMonitor.setLimit(int(repairLoopLimit), time.Duration(repairWindow) * time.Second)
+	router.SetEventHandler(loopMonitor.handleEvent)
+	daoAckAttempts := config.GetDefault("router.dao_ack_attempts",
+	                                    int64(router.DEFAULT_DAO_ACK_ATTEMPTS)).(int64)
+	router.SetDaoAckAttempts(int(daoAckAttempts))
+	daoAckInterval := config.GetDefault("router.dao_ack_interval",
+	                                    int64(DEFAULT_DAO_ACK_INTERVAL.Seconds())).(int64)
+	allowlist, err := readMoteIds(config.GetDefault("router.dao_allowlist", []interface{}{}))
+	if err != nil {
+		log.Fatal(err)
+	}
+	router.SetDaoAllowlist(allowlist)
+	staticLinks, err := readStaticRoutes(config.GetDefault("routes.links", []interface{}{}),
+	                                     config.GetDefault("routes.paths", []interface{}{}))
+	if err != nil {
+		log.Fatal(err)
+	}
+	router.SetStaticLinks(staticLinks)
+	snapshotFile := config.GetDefault("router.snapshot_file", DEFAULT_SNAPSHOT_FILE).(string)
+	snapshotInterval := config.GetDefault("router.snapshot_interval",
+	                                      int64(DEFAULT_SNAPSHOT_INTERVAL.Seconds())).(int64)
+	if snapshotFile != "" {
+		if err := restoreTables(snapshotFile); err != nil {
+			log.Printf(log.ERROR, "Can't restore routing tables from %s: %v\n", snapshotFile,
+			           err)
+		}
+	}
+	switch mop := config.GetDefault("router.mop", "dio").(string); mop {
+	case "dio":
+		router.SetMop(router.MOP_NON_STORING, true)
+	case "non-storing":
+		router.SetMop(router.MOP_NON_STORING, false)
+	case "storing":
+		router.SetMop(router.MOP_STORING, false)
+	default:
+		log.Fatal("Invalid router.mop ", mop)
+	}
+
 	// open serial port to root mote
 	options := serial.RawOptions
 	options.BitRate = 19200
@@ -69,14 +199,21 @@ func main() {
 		log.Panic(err)
 	}
 	defer port.Close()
+	rootPort = port
 
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go readSerial(&wg, port)
+	go router.SweepRoutes(time.Duration(sweepInterval) * time.Second)
+	go retryDaoAcks(time.Duration(daoAckInterval) * time.Second)
+	if (snapshotFile != "") && (snapshotInterval > 0) {
+		go persistTables(snapshotFile, time.Duration(snapshotInterval) * time.Second)
+	}
+	go readConsole(os.Stdin)
 
 	time.Sleep(5 * time.Second)
 	wg.Add(1)
-	go setDagRoot(&wg, port)
+	go setDagRoot(&wg)
 	wg.Wait()
 }
 
@@ -5,7 +5,7 @@ go 1.13
 require (
 	github.com/lunixbochs/struc v0.0.0-20200707160740-784aaebc1d40
 	github.com/mikepb/go-serial v0.0.0-20180731022703-d5134cecf05a
-	github.com/pelletier/go-toml v1.8.0 // indirect
+	github.com/pelletier/go-toml v1.8.0
 	github.com/snksoft/crc v1.1.0
 	github.com/stretchr/testify v1.6.1
 )
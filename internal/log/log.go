@@ -37,12 +37,12 @@ func SetLevel(level Level) {
 
 // Always prints, so level not specified
 func Fatal(v ...interface{}) {
-	log.Fatal(v)
+	log.Fatal(v...)
 }
 
 // Always prints, so level not specified
 func Panic(v ...interface{}) {
-	log.Panic(v)
+	log.Panic(v...)
 }
 
 func Printf(level Level, format string, v ...interface{}) {
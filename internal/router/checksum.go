@@ -0,0 +1,144 @@
+package router
+
+// Functions to verify and set the checksum of upper layer messages, ICMPv6 and UDP.
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A UDP checksum elided by NHC, RFC 6282 sec. 4.3.2, which can't be verified
+var ErrChecksumElided = errors.New("UDP checksum elided; can't verify")
+
+/*
+Calculates the checksum for an upper layer message, per RFC 8200 sec. 8.1. The
+sum includes the IPv6 pseudo-header:
+
+ +-----------------------------------------------+
+ |                Source Address                 |
+ +-----------------------------------------------+
+ |              Destination Address              |
+ +-----------------------------------------------+
+ |            Upper-Layer Packet Length          |
+ +-----------------------------------------------+
+ |              zero             |  Next Header  |
+ +-----------------------------------------------+
+
+The message must include its checksum field. If the checksum in the message is
+correct, the result is 0xFFFF. To generate a checksum, zero the field in the
+message and use the ones' complement of the result.
+*/
+func UpperLayerChecksum(source *[16]byte, dest *[16]byte, nextHeader byte, msg []byte) uint16 {
+	sum := sumWords(0, source[:])
+	sum = sumWords(sum, dest[:])
+	length := uint32(len(msg))
+	sum += (length >> 16) + (length & 0xFFFF)
+	sum += uint32(nextHeader)
+	sum = sumWords(sum, msg)
+
+	for (sum >> 16) != 0 {
+		sum = (sum & 0xFFFF) + (sum >> 16)
+	}
+	return uint16(sum)
+}
+
+// Adds the 16-bit words in data to sum; pads an odd length with a zero byte
+func sumWords(sum uint32, data []byte) uint32 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += (uint32(data[i]) << 8) + uint32(data[i+1])
+	}
+	if (len(data) % 2) == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	return sum
+}
+
+/*
+Rebuilds the 8 byte UDP header for a datagram whose header was compressed with
+NHC. The UDP length is elided by NHC, so it is derived from the length of the
+UDP payload.
+*/
+func UdpHeader(ip *IpData, payloadLen int) []byte {
+	length := payloadLen + 8
+	srcPort := ip.Fields["udp_src_port"]
+	destPort := ip.Fields["udp_dest_port"]
+	checksum := ip.Fields["udp_checksum"]
+	return []byte{byte(srcPort >> 8), byte(srcPort), byte(destPort >> 8), byte(destPort),
+	              byte(length >> 8), byte(length), byte(checksum >> 8), byte(checksum)}
+}
+
+/*
+Verifies the checksum for the upper layer message in data, which follows the
+IP header described by ip. For a UDP header compressed with NHC, data is the
+UDP payload, and the header is rebuilt from ip.
+
+Returns an error if the checksum is not valid, or if it can't be verified.
+Returns ErrChecksumElided if the checksum was elided, which is not an error in
+the packet.
+*/
+func VerifyChecksum(ip *IpData, data []byte) error {
+	nextHeader := byte(ip.Fields["next_header"])
+	msg := data
+
+	switch nextHeader {
+	case IANA_ICMPv6:
+		if len(msg) < 4 {
+			return errors.New(fmt.Sprintf("ICMPv6 message too short %d", len(msg)))
+		}
+	case IANA_UDP:
+		if _, ok := ip.Fields["udp_src_port"]; ok {
+			if ip.Fields["udp_checksum_elided"] == 1 {
+				return ErrChecksumElided
+			}
+			msg = append(UdpHeader(ip, len(data)), data...)
+		} else if len(msg) < 8 {
+			return errors.New(fmt.Sprintf("UDP datagram too short %d", len(msg)))
+		}
+		// RFC 8200 sec. 8.1; zero UDP checksum not allowed for IPv6
+		if (msg[6] == 0) && (msg[7] == 0) {
+			return errors.New("UDP checksum is zero")
+		}
+	default:
+		return errors.New(fmt.Sprintf("no checksum for next header 0x%X", nextHeader))
+	}
+
+	if UpperLayerChecksum(&ip.Source, &ip.Dest, nextHeader, msg) != 0xFFFF {
+		return errors.New(fmt.Sprintf("%s checksum not valid", nextHeaderStr(nextHeader)))
+	}
+	return nil
+}
+
+func nextHeaderStr(nextHeader byte) string {
+	if nextHeader == IANA_UDP {
+		return "UDP"
+	}
+	return "ICMPv6"
+}
+
+/*
+Sets the checksum field in msg, an ICMPv6 or UDP message including its header,
+for transmission from source to dest.
+*/
+func SetChecksum(source *[16]byte, dest *[16]byte, nextHeader byte, msg []byte) error {
+	var pos int
+	switch nextHeader {
+	case IANA_ICMPv6:
+		pos = 2
+	case IANA_UDP:
+		pos = 6
+	default:
+		return errors.New(fmt.Sprintf("no checksum for next header 0x%X", nextHeader))
+	}
+	if len(msg) < pos + 2 {
+		return errors.New(fmt.Sprintf("%s message too short %d", nextHeaderStr(nextHeader),
+		                              len(msg)))
+	}
+	msg[pos], msg[pos+1] = 0, 0
+	checksum := ^UpperLayerChecksum(source, dest, nextHeader, msg)
+	// RFC 768; a computed zero UDP checksum is transmitted as all ones
+	if (nextHeader == IANA_UDP) && (checksum == 0) {
+		checksum = 0xFFFF
+	}
+	msg[pos], msg[pos+1] = byte(checksum >> 8), byte(checksum)
+	return nil
+}
@@ -0,0 +1,81 @@
+package router
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+// IPHC with NHC UDP header, ports and checksum inline; checksum filled in by test
+var udpData = []byte{
+0x7E, 0x55, 0x82, 0x54, 0x7D, 0x13, 0x76, 0x65, 0x79, 0x78,
+0x46, 0x1D, 0x52, 0x44, 0x7B, 0x43, 0x76, 0x78, 0xF0, 0xF0,
+0xB1, 0x16, 0x33, 0x00, 0x00, 0x01, 0x02, 0x03,
+}
+
+// Tests ICMPv6 checksum for the DAO in router_test.go
+func TestIcmpChecksum(t *testing.T) {
+	ip:= new(IpData)
+	ReadData(ip, 0x78, data)
+	err := ReadData(ip, 0x78, data[4:])
+	assert.Nil(t, err)
+	assert.Nil(t, VerifyChecksum(ip, data[23:]))
+
+	// corrupt a byte in the DAO
+	badData := make([]byte, len(data)-23)
+	copy(badData, data[23:])
+	badData[10] ^= 0x01
+	assert.NotNil(t, VerifyChecksum(ip, badData))
+}
+
+// Tests UDP checksum with a header compressed by NHC
+func TestUdpChecksum(t *testing.T) {
+	ip:= new(IpData)
+	err := ReadData(ip, 0x78, udpData)
+	assert.Nil(t, err)
+	assert.Equal(t, int(IANA_UDP), ip.Fields["next_header"])
+	assert.Equal(t, 0xF0B1, ip.Fields["udp_src_port"])
+	assert.Equal(t, 0x1633, ip.Fields["udp_dest_port"])
+	assert.Equal(t, 25, ip.Fields["payload"])
+
+	// generate checksum, and write it into the packet
+	sum := ^UpperLayerChecksum(&ip.Source, &ip.Dest, IANA_UDP,
+	                           append(UdpHeader(ip, 3), udpData[25:]...))
+	ip.Fields["udp_checksum"] = int(sum)
+	assert.Nil(t, VerifyChecksum(ip, udpData[25:]))
+
+	ip.Fields["udp_checksum"] = int(sum ^ 0x0100)
+	assert.NotNil(t, VerifyChecksum(ip, udpData[25:]))
+
+	// can't verify an elided checksum, but not a bad checksum
+	ip.Fields["udp_checksum_elided"] = 1
+	assert.Equal(t, ErrChecksumElided, VerifyChecksum(ip, udpData[25:]))
+}
+
+// Tests reconstruction of source address elided in favor of link layer address
+func TestElidedAddress(t *testing.T) {
+	ip:= new(IpData)
+	ip.LinkSource = [8]byte{0x82, 0x54, 0x7D, 0x13, 0x76, 0x65, 0x79, 0x78}
+	// SAM elided, DAM 16 bits, HLIM inline
+	err := ReadData(ip, 0x78, []byte{0x78, 0x76, 0x3A, 0x10, 0x00, 0x01})
+	assert.Nil(t, err)
+	source := [16]byte{0xBB, 0xBB, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	                   0x82, 0x54, 0x7D, 0x13, 0x76, 0x65, 0x79, 0x78}
+	assert.Equal(t, source, ip.Source)
+	dest := [16]byte{0xBB, 0xBB, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	                 0x00, 0x00, 0x00, 0xFF, 0xFE, 0x00, 0x00, 0x01}
+	assert.Equal(t, dest, ip.Dest)
+	assert.Equal(t, 16, ip.Fields["hop_limit"])
+	assert.Equal(t, 6, ip.Fields["payload"])
+}
+
+// Tests a checksum set for an ICMPv6 message then verifies
+func TestSetChecksum(t *testing.T) {
+	ip := &IpData{Source: NodeAddress(rootId[:]), Dest: NodeAddress(moteA),
+	              Fields: map[string]int{"next_header": int(IANA_ICMPv6)}}
+	msg := []byte{ICMPv6_TYPE_ECHO_REPLY, 0x00, 0xAA, 0xAA, 0x12, 0x34, 0x00, 0x01}
+	assert.Nil(t, SetChecksum(&ip.Source, &ip.Dest, IANA_ICMPv6, msg))
+	assert.Nil(t, VerifyChecksum(ip, msg))
+
+	assert.NotNil(t, SetChecksum(&ip.Source, &ip.Dest, IANA_UDP, msg[:4]))
+	assert.NotNil(t, SetChecksum(&ip.Source, &ip.Dest, IPV6_HEADER, msg))
+}
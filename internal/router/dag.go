@@ -0,0 +1,573 @@
+package router
+
+/*
+Routing table for the DODAG, built from the Transit options in DAOs. A mote may
+advertise several parents, so the table is a DAG rather than a tree. Each node
+keeps links to its parents, ordered by Path Control preference, and the root
+reaches every node through the children lists.
+
+Nodes are indexed by EUI-64, so a DAO finds its nodes in constant time. Checks
+that depend on the shape of the DAG, for loops and for reachability, climb the
+parent links from a node rather than search down from the root, so their cost
+follows the depth of the DAG rather than the number of motes.
+*/
+
+import (
+	"github.com/kb2ma/daghead/internal/log"
+	"sort"
+	"time"
+)
+
+const (
+	// RFC 6550 sec. 17
+	DEFAULT_LIFETIME_UNIT int  = 0xFFFF
+	INFINITE_LIFETIME     byte = 0xFF
+	// Path Lifetime for a No-Path DAO, which removes a link
+	NO_PATH_LIFETIME      byte = 0
+)
+
+// EUI-64 of a mote, which keys the index of nodes in the routing table
+type Eui64 [8]byte
+
+// Node in the routing table. Sequence values are NO_SEQUENCE until known.
+type RplNode struct {
+	Id []byte
+	key Eui64
+	// DAOSequence from the last DAO sent by this node
+	daoSequence int
+	// Path Sequence from the last Transit options for this node as a target
+	pathSequence int
+	// links to parents, most preferred first
+	parents []*RplLink
+	children []*RplNode
+	// prefixes advertised by this node, other than its own address
+	prefixes []*PrefixRoute
+	// latest rank from a DIO or RPI, or NO_RANK
+	rank int
+	// time of the latest rank, even if unchanged
+	rankUpdated time.Time
+	// inconsistencies found when the rank last was updated
+	rankFlags RankFlags
+}
+
+/*
+Downlink from parent to child, from a DAO Transit option. A higher PathControl
+value is more preferred, since RFC 6550 sec. 9.9 assigns the most significant
+bits to the most preferred parents. A zero expires time means the link does not
+expire. A Suspect link has reported errors, so it is avoided when selecting a
+route. A Static link is configured rather than learned from DAOs. A Stale link
+was restored from a saved routing table, and not yet refreshed by a DAO.
+*/
+type RplLink struct {
+	Parent *RplNode
+	Child *RplNode
+	PathControl byte
+	Suspect bool
+	ErrorCount int
+	Static bool
+	Stale bool
+	lifetime byte
+	expires time.Time
+}
+
+// Parent link advertised in a DAO, for updating the routing table
+type linkUpdate struct {
+	parentId []byte
+	pathControl byte
+	pathSequence byte
+	lifetime byte
+}
+
+/*
+Sets the seconds per unit of a DAO Path Lifetime, for links added or refreshed
+after this call. Applies to all routers, and to routers created later.
+*/
+func SetLifetimeUnit(seconds int) {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	defaultLifetimeUnit = seconds
+	for _, r := range routers {
+		r.setLifetimeUnit(seconds)
+	}
+}
+
+// Sets the seconds per unit of a DAO Path Lifetime for this router only, as
+// learned from a DIO. Ignores zero, which would expire every route at once.
+func (r *Router) SetLifetimeUnit(seconds int) {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	r.setLifetimeUnit(seconds)
+}
+
+func (r *Router) setLifetimeUnit(seconds int) {
+	if (seconds != r.lifetimeUnit) && (seconds > 0) {
+		r.lifetimeUnit = seconds
+		log.Printf(log.INFO, "Set route lifetime unit to %d s for instance %d\n", seconds,
+		           r.key.InstanceId)
+	}
+}
+
+// Creates a node with a copy of id
+func newNode(id []byte) *RplNode {
+	nodeId := make([]byte, len(id))
+	copy(nodeId, id)
+	return &RplNode{Id: nodeId, key: toEui64(id), daoSequence: NO_SEQUENCE,
+	                pathSequence: NO_SEQUENCE, rank: NO_RANK}
+}
+
+// Returns the index key for a mote ID, which is the mote's EUI-64
+func toEui64(id []byte) Eui64 {
+	var key Eui64
+	copy(key[:], id)
+	return key
+}
+
+// Verify ID matches node's ID
+func isNodeId(node *RplNode, id []byte) (bool) {
+	return (len(id) == len(node.Id)) && (node.key == toEui64(id))
+}
+
+// Finds the node for id, including the root node
+func (r *Router) findNode(id []byte) (*RplNode, bool) {
+	node, ok := r.nodes[toEui64(id)]
+	return node, ok
+}
+
+// Returns the most preferred parent for node, or nil if none
+func (node *RplNode) preferredParent() *RplNode {
+	if len(node.parents) == 0 {
+		return nil
+	}
+	return node.parents[0].Parent
+}
+
+/*
+Rejects a link from parent to child because the parent is a descendant of the
+child, so the link would create a routing loop. Emits an EVENT_LOOP_DETECTED.
+*/
+func (r *Router) rejectLoop(child *RplNode, parent *RplNode) {
+	log.Printf(log.ERROR, "Rejected loop; can't link child [% X] below its descendant [% X]\n",
+	           child.Id, parent.Id)
+	r.queueEvent(Event{Type: EVENT_LOOP_DETECTED, NodeId: child.Id, ParentId: parent.Id})
+}
+
+/*
+Reports a possible routing loop detected in the data path, as from the RPI R
+flag in a packet from the node for id. Emits an EVENT_LOOP_DETECTED with no
+parent. The routing table must not be locked.
+*/
+func (r *Router) ReportLoop(id []byte) {
+	emitEvents([]Event{{Type: EVENT_LOOP_DETECTED, Dodag: r.Key(), NodeId: id}})
+}
+
+// Returns true if node is, or is below, ancestor. Climbs from node toward the root.
+func isDescendant(node *RplNode, ancestor *RplNode) bool {
+	return climbsTo(node, func(n *RplNode) bool { return n == ancestor })
+}
+
+// Returns true if node still is reachable from the root through its parents
+func (r *Router) reachesRoot(node *RplNode) bool {
+	return climbsTo(node, func(n *RplNode) bool { return n == r.rootNode })
+}
+
+/*
+Returns true if isGoal is true for node or for any node above it, following
+the links to parents. Visits each node at most once, since a node may be
+reached through several parents.
+*/
+func climbsTo(node *RplNode, isGoal func(*RplNode) bool) bool {
+	// usually a chain of single parents, so only track visits at a fork
+	var visited map[*RplNode]bool
+	stack := []*RplNode{node}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if isGoal(n) {
+			return true
+		}
+		if len(n.parents) > 1 && visited == nil {
+			visited = make(map[*RplNode]bool)
+		}
+		for _, link := range n.parents {
+			if visited != nil {
+				if visited[link.Parent] {
+					continue
+				}
+				visited[link.Parent] = true
+			}
+			stack = append(stack, link.Parent)
+		}
+	}
+	return false
+}
+
+/*
+Updates the routing table with the complete set of parents advertised by a
+child in a DAO. Adds the child if not known, refreshes links to parents already
+known, and removes links to parents no longer advertised. A child moves with its
+subtree, since the subtree is reached through the child's children.
+
+The updates for a child share the same Path Sequence. Ignores the updates if
+the Path Sequence is older than the last one accepted. Also ignores a parent
+that is a descendant of the child, although a link already in the table can't
+create a loop, so only a new link is checked. A link to a parent that is not in the table
+waits in the pending links, and replaces any link already pending from the
+child's earlier DAO. If none of the parents are usable, leaves the existing
+links in place. A child with a static parent keeps its links.
+
+A newer Path Sequence shows the child still reaches its parents, so it clears
+the errors and suspect mark on the links it refreshes.
+*/
+func (r *Router) updateLinks(childId []byte, updates []linkUpdate) {
+	if len(updates) == 0 {
+		return
+	}
+	pathSequence := updates[0].pathSequence
+	child, isKnown := r.findNode(childId)
+	isNewer := true
+	if !isKnown {
+		child = newNode(childId)
+	} else if child.pathSequence != NO_SEQUENCE {
+		order := CompareSequence(pathSequence, byte(child.pathSequence))
+		if order == SEQ_LESS {
+			log.Printf(log.WARN, "Ignoring stale path sequence %d for [% X]; last %d\n",
+			           pathSequence, childId, child.pathSequence)
+			return
+		}
+		isNewer = (order == SEQ_GREATER)
+	}
+	r.removePending(childId, nil)
+	if isKnown && child.hasStaticParent() {
+		child.pathSequence = int(pathSequence)
+		log.Printf(log.DEBUG, "Keeping static parents for child [% X]\n", childId)
+		return
+	}
+
+	links := make([]*RplLink, 0, len(updates))
+	for _, update := range updates {
+		parent, ok := r.findNode(update.parentId)
+		if !ok {
+			r.addPending(childId, update)
+			continue
+		}
+		link := child.findLink(parent)
+		if (link == nil) && isKnown && isDescendant(parent, child) {
+			r.rejectLoop(child, parent)
+			continue
+		}
+		if link == nil {
+			link = &RplLink{Parent: parent, Child: child}
+			log.Printf(log.INFO, "added parent [% X] -> child [% X]\n", parent.Id, child.Id)
+		} else if isNewer && (link.Suspect || (link.ErrorCount > 0)) {
+			link.Suspect = false
+			link.ErrorCount = 0
+			r.invalidateRoutes()
+			log.Printf(log.INFO, "Link [% X] -> [% X] refreshed; errors cleared\n", parent.Id,
+			           child.Id)
+		}
+		link.PathControl = update.pathControl
+		link.setLifetime(update.lifetime, r.lifetimeUnit)
+		links = append(links, link)
+	}
+	if len(links) == 0 {
+		return
+	}
+
+	if !isKnown {
+		r.nodes[child.key] = child
+	}
+	if child.pathSequence != int(pathSequence) {
+		child.pathSequence = int(pathSequence)
+		log.Printf(log.DEBUG, "update child [% X] path sequence to %d\n", child.Id,
+		           pathSequence)
+	}
+
+	oldParent := child.preferredParent()
+	oldParents := child.parents
+	for _, link := range child.parents {
+		if !containsLink(links, link) {
+			link.Parent.removeChild(child)
+			log.Printf(log.INFO, "removed parent [% X] -> child [% X]\n", link.Parent.Id,
+			           child.Id)
+		}
+	}
+	for _, link := range links {
+		if child.findLink(link.Parent) == nil {
+			link.Parent.children = append(link.Parent.children, child)
+		}
+	}
+	child.parents = links
+	sortParents(child)
+	if !sameLinks(oldParents, child.parents) {
+		r.invalidateRoutes()
+	}
+
+	newParent := child.preferredParent()
+	if (oldParent != nil) && (oldParent != newParent) {
+		log.Printf(log.INFO, "moved child [% X] from parent [% X] to parent [% X]\n", child.Id,
+		           oldParent.Id, newParent.Id)
+		r.queueEvent(Event{Type: EVENT_PARENT_CHANGED, NodeId: child.Id, ParentId: newParent.Id,
+		                   OldParentId: oldParent.Id})
+	}
+	if !isKnown {
+		r.attachStatic(child)
+		r.attachPending(child)
+	}
+}
+
+// Returns true if the two lists contain the same links in the same order
+func sameLinks(a []*RplLink, b []*RplLink) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Sorts the links to parents of node, most preferred first
+func sortParents(node *RplNode) {
+	sort.SliceStable(node.parents, func(i, j int) bool {
+		return node.parents[i].PathControl > node.parents[j].PathControl
+	})
+}
+
+/*
+Removes the links to parents in a No-Path DAO for a child, and any nodes left
+unreachable. Emits an EVENT_ROUTE_REMOVED for each link removed. As for
+r.updateLinks(), ignores the updates if the Path Sequence is stale. Does not
+remove a static link.
+*/
+func (r *Router) removeLinks(childId []byte, updates []linkUpdate) {
+	if len(updates) == 0 {
+		return
+	}
+	for _, update := range updates {
+		r.removePending(childId, update.parentId)
+	}
+	child, ok := r.findNode(childId)
+	if !ok || (child == r.rootNode) {
+		log.Printf(log.DEBUG, "No-Path for unknown child [% X]\n", childId)
+		return
+	}
+	pathSequence := updates[0].pathSequence
+	if child.pathSequence != NO_SEQUENCE {
+		if CompareSequence(pathSequence, byte(child.pathSequence)) == SEQ_LESS {
+			log.Printf(log.WARN, "Ignoring stale No-Path sequence %d for [% X]; last %d\n",
+			           pathSequence, childId, child.pathSequence)
+			return
+		}
+	}
+	child.pathSequence = int(pathSequence)
+
+	for _, update := range updates {
+		parent, ok := r.findNode(update.parentId)
+		if !ok {
+			continue
+		}
+		link := child.findLink(parent)
+		if (link == nil) || link.Static {
+			continue
+		}
+		r.removeLink(link)
+		log.Printf(log.INFO, "No-Path removed parent [% X] -> child [% X]\n", parent.Id,
+		           child.Id)
+		removed := r.pruneUnreachable(child)
+		r.queueEvent(Event{Type: EVENT_ROUTE_REMOVED, NodeId: child.Id, ParentId: parent.Id,
+		                   Removed: removed})
+		if len(removed) > 0 {
+			// child itself was removed
+			return
+		}
+	}
+}
+
+// Returns the link from parent to node, or nil if none
+func (node *RplNode) findLink(parent *RplNode) *RplLink {
+	for _, link := range node.parents {
+		if link.Parent == parent {
+			return link
+		}
+	}
+	return nil
+}
+
+func containsLink(links []*RplLink, link *RplLink) bool {
+	for _, l := range links {
+		if l == link {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes child from node's children
+func (node *RplNode) removeChild(child *RplNode) {
+	for i, c := range node.children {
+		if c == child {
+			node.children = append(node.children[:i], node.children[i+1:]...)
+			return
+		}
+	}
+}
+
+// Removes link from the table. Does not remove nodes left unreachable.
+func (r *Router) removeLink(link *RplLink) {
+	r.invalidateRoutes()
+	link.Parent.removeChild(link.Child)
+	child := link.Child
+	for i, l := range child.parents {
+		if l == link {
+			child.parents = append(child.parents[:i], child.parents[i+1:]...)
+			break
+		}
+	}
+}
+
+/*
+Removes nodes that no longer are reachable from the root, starting from node.
+Returns the IDs of the nodes removed, in depth first order from node.
+
+A node is removed only if none of its parents reaches the root. Since a removed
+node drops its links, a descendant reached only through removed nodes also does
+not reach the root when its turn comes.
+*/
+func (r *Router) pruneUnreachable(node *RplNode) [][]byte {
+	var removed [][]byte
+	visited := make(map[*RplNode]bool)
+	var prune func(*RplNode)
+	prune = func(n *RplNode) {
+		visited[n] = true
+		if r.reachesRoot(n) {
+			return
+		}
+		removed = append(removed, n.Id)
+		delete(r.nodes, n.key)
+		r.invalidateRoutes()
+		children := n.children
+		n.children = nil
+		for _, link := range n.parents {
+			link.Parent.removeChild(n)
+		}
+		n.parents = nil
+		for _, child := range children {
+			if link := child.findLink(n); link != nil {
+				r.removeLink(link)
+			}
+			if !visited[child] {
+				prune(child)
+			}
+		}
+	}
+	prune(node)
+	return removed
+}
+
+// Sets the lifetime of the link, in units of seconds, and refreshes its expiry
+func (link *RplLink) setLifetime(lifetime byte, unit int) {
+	link.Stale = false
+	link.lifetime = lifetime
+	link.expires = expiryTime(lifetime, unit)
+}
+
+// Returns the time when a DAO Path Lifetime expires, or zero for an infinite lifetime
+func expiryTime(lifetime byte, unit int) time.Time {
+	if lifetime == INFINITE_LIFETIME {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(int(lifetime) * unit) * time.Second)
+}
+
+/*
+Removes the links in each routing table that have expired as of now, and any
+nodes left unreachable. Emits an EVENT_ROUTE_EXPIRED for each expired link.
+Also drops pending links that have timed out, expired prefix and next-hop
+routes, and expired Tracks.
+*/
+func ExpireRoutes(now time.Time) {
+	tableLock.Lock()
+	for _, r := range routers {
+		r.expireRoutes(now)
+	}
+	events := takeEvents()
+	tableLock.Unlock()
+
+	emitEvents(events)
+}
+
+// Removes expired links from this router; the routing table must be locked
+func (r *Router) expireRoutes(now time.Time) {
+	var expired []*RplLink
+	r.expirePending(now)
+	r.expirePrefixes(now)
+	r.expireNextHops(now)
+	r.expireTracks(now)
+	for _, node := range r.nodes {
+		for _, link := range node.parents {
+			if !link.expires.IsZero() && !now.Before(link.expires) {
+				expired = append(expired, link)
+			}
+		}
+	}
+	for _, link := range expired {
+		// may have been pruned with an earlier link
+		if node, ok := r.findNode(link.Child.Id); !ok || (node != link.Child) {
+			continue
+		}
+		r.removeLink(link)
+		r.queueEvent(Event{Type: EVENT_ROUTE_EXPIRED, NodeId: link.Child.Id,
+		                   ParentId: link.Parent.Id, Removed: r.pruneUnreachable(link.Child)})
+	}
+}
+
+// Periodically removes expired links from the routing table. Does not return,
+// so run as a goroutine.
+func SweepRoutes(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for now := range ticker.C {
+		ExpireRoutes(now)
+	}
+}
+
+/*
+Selects the route from the root to the node for id, as the list of node IDs
+starting with the root. Follows the most preferred parent from each node, and
+falls back to an alternate parent if the preferred parent does not lead to the
+root. Tries suspect links only after the others. Returns false if there is no
+route.
+
+Remembers each node that does not lead to the root, so a node shared by many
+alternate paths is climbed only once.
+*/
+func (r *Router) selectRoute(id []byte) ([][]byte, bool) {
+	node, ok := r.findNode(id)
+	if !ok {
+		return nil, false
+	}
+	onPath := make(map[*RplNode]bool)
+	deadEnd := make(map[*RplNode]bool)
+	var climb func(*RplNode) ([][]byte, bool)
+	climb = func(n *RplNode) ([][]byte, bool) {
+		if n == r.rootNode {
+			return [][]byte{n.Id}, true
+		}
+		onPath[n] = true
+		defer delete(onPath, n)
+		for _, suspect := range []bool{false, true} {
+			for _, link := range n.parents {
+				if (link.Suspect != suspect) || onPath[link.Parent] || deadEnd[link.Parent] {
+					continue
+				}
+				if route, ok := climb(link.Parent); ok {
+					return append(route, n.Id), true
+				}
+			}
+		}
+		deadEnd[n] = true
+		return nil, false
+	}
+	return climb(node)
+}
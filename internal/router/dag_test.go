@@ -0,0 +1,241 @@
+package router
+
+import (
+  "testing"
+  "time"
+  "github.com/stretchr/testify/assert"
+)
+
+var (
+	rootId = [8]byte{0x46, 0x1D, 0x52, 0x44, 0x7B, 0x43, 0x76, 0x78}
+	moteA = []byte{0x82, 0x54, 0x7D, 0x13, 0x76, 0x65, 0x79, 0x78}
+	moteB = []byte{0x82, 0x54, 0x7D, 0x13, 0x76, 0x65, 0x79, 0x79}
+	moteC = []byte{0x82, 0x54, 0x7D, 0x13, 0x76, 0x65, 0x79, 0x7A}
+	moteD = []byte{0x82, 0x54, 0x7D, 0x13, 0x76, 0x65, 0x79, 0x7B}
+)
+
+// Updates links for child with a single parent
+func updateLink(r *Router, parentId []byte, childId []byte, sequence byte, lifetime byte) {
+	r.updateLinks(childId, []linkUpdate{{parentId: parentId, pathSequence: sequence,
+	                                     lifetime: lifetime}})
+}
+
+/*
+Removes all routers and the root mote, and restores the package settings to
+their defaults, both now and when t completes. So a test does not depend on the
+tests run before it.
+*/
+func resetRouters(t testing.TB) {
+	resetGlobals()
+	t.Cleanup(resetGlobals)
+}
+
+func resetGlobals() {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	routers = nil
+	rootMoteId = nil
+	restoredTables = nil
+	staticLinks = nil
+	eventHandler = nil
+	pendingEvents = nil
+	defaultLifetimeUnit = DEFAULT_LIFETIME_UNIT
+	defaultMop = MOP_NON_STORING
+	mopFromDio = true
+	linkErrorLimit = DEFAULT_LINK_ERROR_LIMIT
+	daoAllowlist = nil
+	daoAckAttempts = DEFAULT_DAO_ACK_ATTEMPTS
+	maxPathLength = DEFAULT_MAX_PATH_LENGTH
+	pendingTimeout = DEFAULT_PENDING_TIMEOUT
+	pdaoAckTimeout = DEFAULT_PDAO_ACK_TIMEOUT
+	trackReleaseTimeout = DEFAULT_TRACK_RELEASE_TIMEOUT
+}
+
+// Tests expiry of a link removes the subtree below it, and emits an event
+func TestExpireRoutes(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	SetLifetimeUnit(60)
+	var events []Event
+	SetEventHandler(func(event Event) {
+		events = append(events, event)
+	})
+
+	updateLink(r, rootId[:], moteA, 1, 10)
+	updateLink(r, moteA, moteB, 1, 0xFF)
+	updateLink(r, rootId[:], moteC, 1, 20)
+
+	ExpireRoutes(time.Now().Add(5 * time.Minute))
+	assert.Equal(t, 2, len(r.rootNode.children))
+	assert.Equal(t, 0, len(events))
+
+	ExpireRoutes(time.Now().Add(15 * time.Minute))
+	assert.Equal(t, 1, len(r.rootNode.children))
+	assert.Equal(t, moteC, r.rootNode.children[0].Id)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, EVENT_ROUTE_EXPIRED, events[0].Type)
+	assert.Equal(t, moteA, events[0].NodeId)
+	assert.Equal(t, [][]byte{moteA, moteB}, events[0].Removed)
+	_, ok := r.findNode(moteB)
+	assert.False(t, ok)
+
+	// refresh extends lifetime
+	updateLink(r, rootId[:], moteC, 2, 30)
+	ExpireRoutes(time.Now().Add(25 * time.Minute))
+	assert.Equal(t, 1, len(r.rootNode.children))
+
+	// lifetime unit of zero from a DIO ignored
+	r.SetLifetimeUnit(0)
+	assert.Equal(t, 60, r.lifetimeUnit)
+}
+
+// Tests moving a child and its subtree to a new parent
+func TestReparent(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	var events []Event
+	SetEventHandler(func(event Event) {
+		events = append(events, event)
+	})
+
+	updateLink(r, rootId[:], moteA, 1, 0xFF)
+	updateLink(r, moteA, moteB, 1, 0xFF)
+	updateLink(r, moteB, moteD, 1, 0xFF)
+	updateLink(r, rootId[:], moteC, 1, 0xFF)
+
+	updateLink(r, moteC, moteB, 2, 0xFF)
+	emitEvents(takeEvents())
+
+	nodeA, _ := r.findNode(moteA)
+	assert.Equal(t, 0, len(nodeA.children))
+	nodeC, _ := r.findNode(moteC)
+	assert.Equal(t, 1, len(nodeC.children))
+	assert.Equal(t, moteB, nodeC.children[0].Id)
+	assert.Equal(t, 2, nodeC.children[0].pathSequence)
+	assert.Equal(t, moteD, nodeC.children[0].children[0].Id)
+
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, EVENT_PARENT_CHANGED, events[0].Type)
+	assert.Equal(t, moteA, events[0].OldParentId)
+	assert.Equal(t, moteC, events[0].ParentId)
+
+	// can't move below a descendant
+	updateLink(r, moteD, moteC, 3, 0xFF)
+	assert.Equal(t, 2, len(r.rootNode.children))
+	events = takeEvents()
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, EVENT_LOOP_DETECTED, events[0].Type)
+	assert.Equal(t, moteC, events[0].NodeId)
+	assert.Equal(t, moteD, events[0].ParentId)
+}
+
+// Tests rejection of a loop through several nodes, and of a node as its own parent
+func TestLoopDetection(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	r.pendingLinks = nil
+	updateLink(r, rootId[:], moteA, 1, 0xFF)
+	updateLink(r, moteA, moteB, 1, 0xFF)
+	updateLink(r, moteB, moteC, 1, 0xFF)
+	takeEvents()
+
+	// A keeps root as a parent, but rejects C
+	r.updateLinks(moteA, []linkUpdate{{parentId: rootId[:], pathSequence: 2, lifetime: 0xFF},
+	                                   {parentId: moteC, pathSequence: 2, lifetime: 0xFF}})
+	nodeA, _ := r.findNode(moteA)
+	assert.Equal(t, 1, len(nodeA.parents))
+	events := takeEvents()
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, EVENT_LOOP_DETECTED, events[0].Type)
+
+	// D names itself as parent; pending until D is added, then rejected
+	r.updateLinks(moteD, []linkUpdate{{parentId: moteD, pathSequence: 1, lifetime: 0xFF},
+	                                   {parentId: moteC, pathSequence: 1, lifetime: 0xFF}})
+	nodeD, _ := r.findNode(moteD)
+	assert.Equal(t, 1, len(nodeD.parents))
+	assert.Equal(t, 0, len(nodeD.children))
+	assert.Equal(t, 0, len(r.PendingLinks()))
+	events = takeEvents()
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, EVENT_LOOP_DETECTED, events[0].Type)
+	assert.Equal(t, moteD, events[0].ParentId)
+}
+
+// Tests a child with two parents, and selection of the preferred route
+func TestMultipleParents(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	updateLink(r, rootId[:], moteA, 1, 0xFF)
+	updateLink(r, rootId[:], moteB, 1, 0xFF)
+	r.updateLinks(moteC, []linkUpdate{{parentId: moteA, pathControl: 0x20, lifetime: 0xFF},
+	                                   {parentId: moteB, pathControl: 0x80, lifetime: 0xFF}})
+
+	nodeC, _ := r.findNode(moteC)
+	assert.Equal(t, 2, len(nodeC.parents))
+	assert.Equal(t, moteB, nodeC.preferredParent().Id)
+	route, ok := r.selectRoute(moteC)
+	assert.True(t, ok)
+	assert.Equal(t, [][]byte{rootId[:], moteB, moteC}, route)
+
+	// remove link to preferred parent; falls back to alternate
+	nodeB, _ := r.findNode(moteB)
+	r.removeLink(nodeB.parents[0])
+	route, ok = r.selectRoute(moteC)
+	assert.True(t, ok)
+	assert.Equal(t, [][]byte{rootId[:], moteA, moteC}, route)
+
+	// next DAO advertises only one parent
+	r.updateLinks(moteC, []linkUpdate{{parentId: moteA, pathControl: 0x80, pathSequence: 1,
+	                                   lifetime: 0xFF}})
+	assert.Equal(t, 1, len(nodeC.parents))
+	assert.Equal(t, 0, len(nodeB.children))
+	takeEvents()
+}
+
+// Tests a stale path sequence does not update links
+func TestStalePathSequence(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	updateLink(r, rootId[:], moteA, 1, 0xFF)
+	updateLink(r, rootId[:], moteB, 1, 0xFF)
+	updateLink(r, moteA, moteC, 5, 0xFF)
+
+	updateLink(r, moteB, moteC, 4, 0xFF)
+	nodeC, _ := r.findNode(moteC)
+	assert.Equal(t, moteA, nodeC.preferredParent().Id)
+
+	updateLink(r, moteB, moteC, 6, 0xFF)
+	assert.Equal(t, moteB, nodeC.preferredParent().Id)
+	takeEvents()
+}
+
+// Tests a No-Path removes a link, and the descendants left unreachable
+func TestNoPath(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	updateLink(r, rootId[:], moteA, 1, 0xFF)
+	updateLink(r, rootId[:], moteB, 1, 0xFF)
+	updateLink(r, moteA, moteC, 1, 0xFF)
+	r.updateLinks(moteD, []linkUpdate{{parentId: moteC, pathSequence: 1, lifetime: 0xFF},
+	                                   {parentId: moteB, pathSequence: 1, lifetime: 0xFF}})
+	takeEvents()
+
+	// D still reachable through B
+	r.removeLinks(moteA, []linkUpdate{{parentId: rootId[:], pathSequence: 2,
+	                                   lifetime: NO_PATH_LIFETIME}})
+	events := takeEvents()
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, EVENT_ROUTE_REMOVED, events[0].Type)
+	assert.Equal(t, [][]byte{moteA, moteC}, events[0].Removed)
+	nodeD, ok := r.findNode(moteD)
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(nodeD.parents))
+	assert.Equal(t, moteB, nodeD.preferredParent().Id)
+
+	// stale No-Path ignored
+	r.removeLinks(moteD, []linkUpdate{{parentId: moteB, pathSequence: 0,
+	                                   lifetime: NO_PATH_LIFETIME}})
+	assert.Equal(t, 0, len(takeEvents()))
+	_, ok = r.findNode(moteD)
+	assert.True(t, ok)
+}
@@ -0,0 +1,249 @@
+package router
+
+/*
+DAO-ACKs for DAOs with the K flag, RFC 6550 sec. 9.3. In non-storing mode the
+DAO is addressed to the root, so daghead acknowledges it. The router records
+the acknowledgements outstanding, and the sender takes them to source route to
+each mote. A taken acknowledgement is in flight until the sender records the
+result, so it is not taken again meanwhile. An acknowledgement that can't be
+sent yet, as when the route to the mote still is pending, stays outstanding for
+a later attempt.
+
+A DAO from a mote not in the allowlist is rejected, and does not update the
+routing table. So the DAO-ACK for the rejection carries its own source route,
+through the parent in the DAO's Transit, or direct from the root.
+*/
+
+import (
+	"bytes"
+	"github.com/kb2ma/daghead/internal/log"
+	"time"
+)
+
+const (
+	// RFC 9010 sec. 6.1; the U bit is set for a rejection
+	DAO_ACK_ACCEPT byte = 0x00
+	DAO_ACK_REJECT byte = 0x80
+
+	// Attempts to send a DAO-ACK before it is dropped
+	DEFAULT_DAO_ACK_ATTEMPTS = 3
+)
+
+// A DAO-ACK to send to a mote
+type DaoAck struct {
+	Dodag DodagKey
+	DestId []byte
+	// DAOSequence of the DAO acknowledged
+	Sequence byte
+	Status byte
+	// Include the DODAGID; set if the DAO included it
+	HasDodagId bool
+	// time the DAO was received
+	Received time.Time
+	// failed attempts to send
+	Attempts int
+	// Source route to the mote, for a mote not in the routing table; nil to
+	// use the routing table
+	Route [][]byte
+	// taken by TakeAcks(), and not yet sent or failed
+	inFlight bool
+}
+
+var (
+	// Motes allowed to send DAOs; nil allows all
+	daoAllowlist map[Eui64]bool
+	daoAckAttempts = DEFAULT_DAO_ACK_ATTEMPTS
+)
+
+// Sets the IDs of the motes allowed to send a DAO. An empty list allows all motes.
+func SetDaoAllowlist(ids [][]byte) {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	if len(ids) == 0 {
+		daoAllowlist = nil
+		return
+	}
+	daoAllowlist = make(map[Eui64]bool, len(ids))
+	for _, id := range ids {
+		daoAllowlist[toEui64(id)] = true
+	}
+}
+
+// Sets the attempts to send a DAO-ACK before it is dropped
+func SetDaoAckAttempts(attempts int) {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	daoAckAttempts = attempts
+}
+
+// Returns true if the mote for id may send a DAO; the routers must be locked
+func isDaoAllowed(id []byte) bool {
+	return (daoAllowlist == nil) || daoAllowlist[toEui64(id)]
+}
+
+/*
+Records a DAO-ACK to send to the mote for destId, for a DAO with the K flag. A
+DAO-ACK still outstanding for an earlier DAO from the mote is replaced. The
+route is nil unless the mote is not in the routing table. The routing table
+must be locked.
+*/
+func (r *Router) queueAck(destId []byte, dao *RplDao, status byte, route [][]byte) {
+	ack := &DaoAck{Dodag: r.key, DestId: append([]byte{}, destId...), Sequence: dao.Sequence,
+	               Status: status, HasDodagId: dao.HasDodagId, Received: time.Now(),
+	               Route: route}
+	log.Printf(log.DEBUG, "Queue DAO-ACK for [% X], sequence %d, status 0x%X\n", destId,
+	           dao.Sequence, status)
+	r.removeAck(destId)
+	r.daoAcks = append(r.daoAcks, ack)
+}
+
+/*
+Returns the source route to the mote for sourceId, from the Transit options in
+its rejected DAO, for a DAO-ACK. The route reaches the mote through the first
+Transit parent in the routing table. A mote with no parent in a Transit, as in
+storing mode, or with the root as parent, is a neighbor of the root. Returns nil
+if no parent is in the routing table. The routing table must be locked.
+*/
+func (r *Router) rejectRoute(sourceId []byte, opts *RplOptions) [][]byte {
+	if r.rootNode == nil {
+		return nil
+	}
+	hasParent := false
+	for _, group := range opts.DaoGroups {
+		for _, transit := range group.Transits {
+			if !transit.HasParent {
+				continue
+			}
+			hasParent = true
+			parentId := transit.Parent[8:]
+			if isNodeId(r.rootNode, parentId) {
+				return [][]byte{copyId(r.rootNode.Id), copyId(sourceId)}
+			}
+			if route, err := r.sourceRoute(parentId); err == nil {
+				if len(route) > maxPathLength {
+					continue
+				}
+				return append(append([][]byte{}, route...), copyId(sourceId))
+			}
+		}
+	}
+	if !hasParent {
+		return [][]byte{copyId(r.rootNode.Id), copyId(sourceId)}
+	}
+	return nil
+}
+
+// Removes the outstanding DAO-ACK for the mote for destId, if any
+func (r *Router) removeAck(destId []byte) {
+	for i, ack := range r.daoAcks {
+		if bytes.Equal(ack.DestId, destId) {
+			r.daoAcks = append(r.daoAcks[:i], r.daoAcks[i+1:]...)
+			return
+		}
+	}
+}
+
+// Finds the outstanding DAO-ACK for the mote and sequence, or nil if not found
+func (r *Router) findAck(destId []byte, sequence byte) *DaoAck {
+	for _, ack := range r.daoAcks {
+		if (ack.Sequence == sequence) && bytes.Equal(ack.DestId, destId) {
+			return ack
+		}
+	}
+	return nil
+}
+
+// Returns copies of the DAO-ACKs outstanding for all routers, oldest first for each
+func OutstandingAcks() []DaoAck {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	var acks []DaoAck
+	for _, r := range routers {
+		for _, ack := range r.daoAcks {
+			acks = append(acks, ack.copy())
+		}
+	}
+	return acks
+}
+
+/*
+Takes the outstanding DAO-ACKs to send, for the mote with destId, or for all
+motes if destId is nil. Marks each in flight, so it is not taken again until
+AckSent() or AckFailed() records the result. Returns copies, oldest first for
+each router.
+*/
+func TakeAcks(destId []byte) []DaoAck {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	var acks []DaoAck
+	for _, r := range routers {
+		for _, ack := range r.daoAcks {
+			if ack.inFlight || ((destId != nil) && !bytes.Equal(ack.DestId, destId)) {
+				continue
+			}
+			ack.inFlight = true
+			acks = append(acks, ack.copy())
+		}
+	}
+	return acks
+}
+
+func (ack *DaoAck) copy() DaoAck {
+	copied := *ack
+	if ack.Route != nil {
+		copied.Route = append([][]byte{}, ack.Route...)
+	}
+	return copied
+}
+
+// Records the DAO-ACK for the mote and sequence was sent, so no longer is outstanding
+func (r *Router) AckSent(destId []byte, sequence byte) {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	if r.findAck(destId, sequence) != nil {
+		r.removeAck(destId)
+	}
+}
+
+/*
+Records a failed attempt to send the DAO-ACK for the mote and sequence. Drops
+the DAO-ACK after the limit on attempts.
+*/
+func (r *Router) AckFailed(destId []byte, sequence byte) {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	ack := r.findAck(destId, sequence)
+	if ack == nil {
+		return
+	}
+	ack.inFlight = false
+	ack.Attempts++
+	if ack.Attempts >= daoAckAttempts {
+		log.Printf(log.WARN, "Dropped DAO-ACK for [% X], sequence %d, after %d attempts\n",
+		           destId, sequence, ack.Attempts)
+		r.removeAck(destId)
+	}
+}
+
+/*
+Returns an ICMPv6 DAO-ACK message for ack, with checksum not yet set.
+
+  0                   1                   2                   3
+  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ |     Type      |     Code      |          Checksum             |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ | RPLInstanceID |D|  Reserved   |  DAOSequence  |    Status     |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ |                  DODAGID (16 bytes, if D flag)                |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+*/
+func EncodeDaoAck(ack *DaoAck) []byte {
+	msg := []byte{ICMPv6_TYPE_RPL, RPL_CODE_DAO_ACK, 0, 0,
+	              ack.Dodag.InstanceId, 0, ack.Sequence, ack.Status}
+	if ack.HasDodagId {
+		msg[ICMPv6_HEADER_LEN + 1] = RPL_DAO_ACK_D_FLAG
+		msg = append(msg, ack.Dodag.DodagId[:]...)
+	}
+	return msg
+}
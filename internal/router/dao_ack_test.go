@@ -0,0 +1,126 @@
+package router
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+// Returns the DAO from data, with the K flag set
+func daoWithAck() []byte {
+	dao := make([]byte, len(data)-23)
+	copy(dao, data[23:])
+	dao[5] |= RPL_DAO_K_FLAG
+	return dao
+}
+
+// Tests a DAO with the K flag queues a DAO-ACK, until sent
+func TestDaoAck(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	ip := &IpData{Fields: make(map[string]int)}
+	copy(ip.Source[8:], moteA)
+	assert.Nil(t, ReadIcmpv6(ip, daoWithAck()))
+
+	acks := OutstandingAcks()
+	assert.Equal(t, 1, len(acks))
+	assert.Equal(t, moteA, acks[0].DestId)
+	assert.Equal(t, byte(1), acks[0].Sequence)
+	assert.Equal(t, DAO_ACK_ACCEPT, acks[0].Status)
+	assert.Equal(t, r.Key(), acks[0].Dodag)
+
+	// taken only once while in flight, and again after a failed attempt
+	assert.Equal(t, 0, len(TakeAcks(moteB)))
+	assert.Equal(t, 1, len(TakeAcks(moteA)))
+	assert.Equal(t, 0, len(TakeAcks(nil)))
+	r.AckFailed(moteA, 1)
+	assert.Equal(t, 1, len(TakeAcks(nil)))
+
+	// wrong sequence ignored
+	r.AckSent(moteA, 2)
+	assert.Equal(t, 1, len(OutstandingAcks()))
+	r.AckSent(moteA, 1)
+	assert.Equal(t, 0, len(OutstandingAcks()))
+
+	// no ack without the K flag
+	dao := daoWithAck()
+	dao[5] &^= RPL_DAO_K_FLAG
+	dao[7] = 2
+	assert.Nil(t, ReadIcmpv6(ip, dao))
+	assert.Equal(t, 0, len(OutstandingAcks()))
+}
+
+// Tests a DAO from a mote not in the allowlist is rejected
+func TestDaoAllowlist(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	SetDaoAllowlist([][]byte{moteB})
+
+	ip := &IpData{Fields: make(map[string]int)}
+	copy(ip.Source[8:], moteA)
+	assert.NotNil(t, ReadIcmpv6(ip, daoWithAck()))
+	_, ok := r.findNode(moteA)
+	assert.False(t, ok)
+	acks := OutstandingAcks()
+	assert.Equal(t, 1, len(acks))
+	assert.Equal(t, DAO_ACK_REJECT, acks[0].Status)
+	// routed through the Transit parent, the root, although A is not in the table
+	assert.Equal(t, [][]byte{rootId[:], moteA}, acks[0].Route)
+	nextHop, _, err := EncodeDownstream(acks[0].Route,
+	                                    &DownstreamPacket{Dest: NodeAddress(moteA), HopLimit: 64,
+	                                                      Payload: EncodeDaoAck(&acks[0])})
+	assert.Nil(t, err)
+	assert.Equal(t, moteA, nextHop)
+
+	// dropped after attempts
+	SetDaoAckAttempts(2)
+	r.AckFailed(moteA, 1)
+	assert.Equal(t, 1, OutstandingAcks()[0].Attempts)
+	r.AckFailed(moteA, 1)
+	assert.Equal(t, 0, len(OutstandingAcks()))
+
+	copy(ip.Source[8:], moteB)
+	assert.Nil(t, ReadIcmpv6(ip, daoWithAck()))
+	_, ok = r.findNode(moteB)
+	assert.True(t, ok)
+	assert.Equal(t, DAO_ACK_ACCEPT, OutstandingAcks()[0].Status)
+	assert.Nil(t, OutstandingAcks()[0].Route)
+}
+
+// Tests the route for the DAO-ACK to a rejected mote, from its Transit parent
+func TestRejectRoute(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	updateLink(r, rootId[:], moteA, 1, 0xFF)
+	updateLink(r, moteA, moteB, 1, 0xFF)
+	transit := func(parent []byte) *RplOptions {
+		transit := RplTransit{HasParent: true, Parent: NodeAddress(parent)}
+		return &RplOptions{DaoGroups: []RplDaoGroup{{Transits: []RplTransit{transit}}}}
+	}
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	assert.Equal(t, [][]byte{rootId[:], moteA, moteB, moteC},
+	             r.rejectRoute(moteC, transit(moteB)))
+	assert.Nil(t, r.rejectRoute(moteC, transit(moteD)))
+	// neighbor of the root in storing mode
+	assert.Equal(t, [][]byte{rootId[:], moteC}, r.rejectRoute(moteC, &RplOptions{}))
+}
+
+// Tests encoding a DAO-ACK, read back as a DAO-ACK base object
+func TestEncodeDaoAck(t *testing.T) {
+	key := DodagKey{InstanceId: 1, DodagId: NodeAddress(rootId[:])}
+	msg := EncodeDaoAck(&DaoAck{Dodag: key, Sequence: 7, Status: DAO_ACK_REJECT,
+	                            HasDodagId: true})
+	assert.Equal(t, ICMPv6_TYPE_RPL, msg[0])
+	assert.Equal(t, RPL_CODE_DAO_ACK, msg[1])
+	ack, i, err := ReadDaoAck(msg[ICMPv6_HEADER_LEN:])
+	assert.Nil(t, err)
+	assert.Equal(t, len(msg) - ICMPv6_HEADER_LEN, i)
+	assert.Equal(t, byte(1), ack.InstanceId)
+	assert.Equal(t, byte(7), ack.Sequence)
+	assert.Equal(t, DAO_ACK_REJECT, ack.Status)
+	assert.True(t, ack.HasDodagId)
+	assert.Equal(t, key.DodagId, ack.DodagId)
+
+	msg = EncodeDaoAck(&DaoAck{Dodag: key, Sequence: 7})
+	assert.Equal(t, ICMPv6_HEADER_LEN + RPL_DAO_ACK_LEN, len(msg))
+}
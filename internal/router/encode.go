@@ -0,0 +1,204 @@
+package router
+
+/*
+Encodes packets sent down into the mesh from the root. In non-storing mode, the
+root inserts a source route, compressed as an SRH-6LoRH (RFC 8138), followed by
+an RPI-6LoRH and an IPHC header, in the same order as OpenVisualizer.
+*/
+
+import (
+	"errors"
+)
+
+const (
+	TYPE_6LoRH_SRH_MAX byte = 4
+	// maximum hops in a single SRH-6LoRH, from the 5-bit Size field
+	SRH_6LoRH_MAX_HOPS int = 32
+	// RFC 6550 sec. 17
+	ROOT_RANK int = 256
+)
+
+// Compressed size of an address for each SRH-6LoRH type, 0-4
+var srhSizes = [5]int{1, 2, 4, 8, 16}
+
+// Contents of a packet to send down into the mesh
+type DownstreamPacket struct {
+	Source [16]byte
+	Dest [16]byte
+	NextHeader byte
+	HopLimit int
+	InstanceId byte
+	SenderRank int
+	// RPI flags to set in addition to O (down)
+	RpiFlags byte
+	// upper layer message, which follows the IPv6 header
+	Payload []byte
+}
+
+// Returns the IPv6 address in NETWORK_PREFIX for a node ID (EUI-64)
+func NodeAddress(id []byte) [16]byte {
+	var addr [16]byte
+	copy(addr[:8], NETWORK_PREFIX[:])
+	copy(addr[8:], id)
+	return addr
+}
+
+/*
+Encodes a packet for transmission down the route. The route is a list of node
+IDs from the root to the destination, as from SourceRoute(). Returns the ID of
+the first hop, which is the link layer destination from the root, and the
+6LoWPAN encoded packet.
+
+The SRH-6LoRH lists the hops after the first hop, through the destination. So
+there is no SRH-6LoRH when the destination is a neighbor of the root.
+*/
+func EncodeDownstream(route [][]byte, pkt *DownstreamPacket) ([]byte, []byte, error) {
+	if len(route) < 2 {
+		return nil, nil, errors.New("route must include root and destination")
+	}
+	nextHop := route[1]
+
+	lowpan := []byte{PAGE_ONE_DISPATCH}
+	if len(route) > 2 {
+		hops := make([][16]byte, 0, len(route) - 2)
+		for _, id := range route[2:] {
+			hops = append(hops, NodeAddress(id))
+		}
+		lowpan = append(lowpan, EncodeSrh6Lorh(NodeAddress(route[0]), hops)...)
+	}
+	lowpan = append(lowpan, EncodeRpi6Lorh(RPI_O_FLAG | pkt.RpiFlags, pkt.InstanceId,
+	                                       pkt.SenderRank)...)
+	lowpan = append(lowpan, EncodeIphc(&pkt.Source, &pkt.Dest, pkt.NextHeader,
+	                                   pkt.HopLimit)...)
+	lowpan = append(lowpan, pkt.Payload...)
+	return nextHop, lowpan, nil
+}
+
+/*
+Encodes the SRH-6LoRH headers for the hops, RFC 8138 sec. 5.1. Each address is
+compressed against the address before it, starting with reference, which is the
+root address. Consecutive
+hops with the same compressed size share a header, so a change in size starts a
+new header.
+
+ 0                   1                   2
+ 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-
+|1|0|0|  Size   |6LoRH Type 0..4| Hop1 | Hop2 ...
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-
+*/
+func EncodeSrh6Lorh(reference [16]byte, hops [][16]byte) []byte {
+	var encoded []byte
+	// index in encoded of the current header, and its type and hop count
+	header := -1
+	var headerType byte
+	count := 0
+
+	for _, hop := range hops {
+		srhType := srhType(&reference, &hop)
+		if (header < 0) || (srhType != headerType) || (count == SRH_6LoRH_MAX_HOPS) {
+			header = len(encoded)
+			headerType = srhType
+			count = 0
+			encoded = append(encoded, CRITICAL_6LoRH, srhType)
+		}
+		size := srhSizes[srhType]
+		encoded = append(encoded, hop[16-size:]...)
+		count++
+		encoded[header] = CRITICAL_6LoRH | byte(count - 1)
+		reference = hop
+	}
+	return encoded
+}
+
+// Returns the SRH-6LoRH type for the smallest compressed size that recovers
+// addr from reference.
+func srhType(reference *[16]byte, addr *[16]byte) byte {
+	common := 0
+	for common < 16 && reference[common] == addr[common] {
+		common++
+	}
+	for t, size := range srhSizes {
+		if 16 - size <= common {
+			return byte(t)
+		}
+	}
+	return TYPE_6LoRH_SRH_MAX
+}
+
+/*
+Encodes an RPI-6LoRH header, RFC 8138 sec. 6.3. Elides the RPL Instance ID if
+zero, and the low byte of the sender rank if zero.
+
+ 0                   1                   2
+ 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+  ...  -+-+-+
+|1|0|0|O|R|F|I|K| 6LoRH Type=5  |   Compressed fields  |
++-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+  ...  -+-+-+
+*/
+func EncodeRpi6Lorh(flags byte, instanceId byte, senderRank int) []byte {
+	flags &= (RPI_O_FLAG | RPI_R_FLAG | RPI_F_FLAG)
+	var fields []byte
+	if instanceId == 0 {
+		flags |= RPI_I_FLAG
+	} else {
+		fields = append(fields, instanceId)
+	}
+	if (senderRank & 0xFF) == 0 {
+		flags |= RPI_K_FLAG
+		fields = append(fields, byte(senderRank >> 8))
+	} else {
+		fields = append(fields, byte(senderRank >> 8), byte(senderRank))
+	}
+	return append([]byte{CRITICAL_6LoRH | flags, TYPE_6LoRH_RPI}, fields...)
+}
+
+/*
+Encodes an IPHC header, RFC 6282 sec. 3.1, with traffic class and flow label
+elided and the next header inline. Addresses in NETWORK_PREFIX are compressed
+statefully to 64 bits; others are inline.
+*/
+func EncodeIphc(source *[16]byte, dest *[16]byte, nextHeader byte, hopLimit int) []byte {
+	// 011 TF NH HLIM
+	b0 := byte(0x60) | (IPHC_TF_ELIDED << 3) | (IPHC_NH_INLINE << 2)
+	// CID SAC SAM M DAC DAM
+	var b1 byte
+	inline := []byte{nextHeader}
+
+	switch hopLimit {
+	case 1:
+		b0 |= IPHC_HLIM_1
+	case 64:
+		b0 |= IPHC_HLIM_64
+	case 255:
+		b0 |= IPHC_HLIM_255
+	default:
+		b0 |= IPHC_HLIM_INLINE
+		inline = append(inline, byte(hopLimit))
+	}
+
+	if isNetworkAddress(source) {
+		b1 |= (IPHC_SAC_STATEFUL << 6) | (IPHC_SAM_64B << 4)
+		inline = append(inline, source[8:]...)
+	} else {
+		b1 |= (IPHC_SAC_STATELESS << 6) | (IPHC_SAM_128B << 4)
+		inline = append(inline, source[:]...)
+	}
+	if isNetworkAddress(dest) {
+		b1 |= (IPHC_DAC_STATEFUL << 2) | IPHC_DAM_64B
+		inline = append(inline, dest[8:]...)
+	} else {
+		inline = append(inline, dest[:]...)
+	}
+	return append([]byte{b0, b1}, inline...)
+}
+
+// Returns true if addr is in NETWORK_PREFIX, and so may be compressed statefully
+func isNetworkAddress(addr *[16]byte) bool {
+	for i := 0; i < 8; i++ {
+		if addr[i] != NETWORK_PREFIX[i] {
+			return false
+		}
+	}
+	return true
+}
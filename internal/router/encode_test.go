@@ -0,0 +1,88 @@
+package router
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+// Tests compressed size of hops, and start of a new header when the size changes
+func TestSrh6Lorh(t *testing.T) {
+	root := NodeAddress(rootId[:])
+	a := NodeAddress(moteA)
+	b := NodeAddress(moteB)
+	far := NodeAddress(moteC)
+	far[0] = 0x20
+
+	// moteA differs from root in IID; moteB differs from moteA in last byte
+	srh := EncodeSrh6Lorh(root, [][16]byte{a, b})
+	assert.Equal(t, []byte{0x80, 0x03, 0x82, 0x54, 0x7D, 0x13, 0x76, 0x65, 0x79, 0x78,
+	                       0x80, 0x00, 0x79}, srh)
+
+	// consecutive hops of the same size share a header
+	srh = EncodeSrh6Lorh(a, [][16]byte{b, NodeAddress(moteC)})
+	assert.Equal(t, []byte{0x81, 0x00, 0x79, 0x7A}, srh)
+
+	// different prefix requires full address
+	srh = EncodeSrh6Lorh(root, [][16]byte{far})
+	assert.Equal(t, 18, len(srh))
+	assert.Equal(t, []byte{0x80, 0x04}, srh[:2])
+	assert.Equal(t, far[:], srh[2:])
+
+	// two byte compression
+	c := a
+	c[14] = 0x00
+	srh = EncodeSrh6Lorh(a, [][16]byte{c})
+	assert.Equal(t, []byte{0x80, 0x01, 0x00, 0x78}, srh)
+}
+
+// Tests round trip of RPI-6LoRH and IPHC through ReadData
+func TestEncodeHeaders(t *testing.T) {
+	rpi := EncodeRpi6Lorh(RPI_O_FLAG, 0, ROOT_RANK)
+	assert.Equal(t, []byte{0x93, 0x05, 0x01}, rpi)
+
+	ip := &IpData{}
+	assert.Nil(t, ReadData(ip, 0, append([]byte{PAGE_ONE_DISPATCH}, rpi...)))
+	assert.Equal(t, int(RPI_O_FLAG | RPI_I_FLAG | RPI_K_FLAG), ip.Fields["hop_flags"])
+	assert.Equal(t, ROOT_RANK, ip.Fields["hop_senderRank"])
+
+	rpi = EncodeRpi6Lorh(RPI_O_FLAG, 2, 0x0123)
+	assert.Equal(t, []byte{0x90, 0x05, 0x02, 0x01, 0x23}, rpi)
+
+	source := NodeAddress(rootId[:])
+	dest := NodeAddress(moteA)
+	iphc := EncodeIphc(&source, &dest, IANA_ICMPv6, 64)
+	ip = &IpData{}
+	assert.Nil(t, ReadData(ip, 0, iphc))
+	assert.Equal(t, source, ip.Source)
+	assert.Equal(t, dest, ip.Dest)
+	assert.Equal(t, int(IANA_ICMPv6), ip.Fields["next_header"])
+	assert.Equal(t, 64, ip.Fields["hop_limit"])
+
+	iphc = EncodeIphc(&source, &dest, IANA_ICMPv6, 20)
+	ip = &IpData{}
+	assert.Nil(t, ReadData(ip, 0, iphc))
+	assert.Equal(t, 20, ip.Fields["hop_limit"])
+}
+
+func TestEncodeDownstream(t *testing.T) {
+	pkt := &DownstreamPacket{Source: NodeAddress(rootId[:]), Dest: NodeAddress(moteB),
+	                         NextHeader: IANA_ICMPv6, HopLimit: 64, SenderRank: ROOT_RANK,
+	                         Payload: []byte{0x80, 0x00, 0x00, 0x00}}
+
+	// neighbor of root; no SRH
+	nextHop, lowpan, err := EncodeDownstream([][]byte{rootId[:], moteB}, pkt)
+	assert.Nil(t, err)
+	assert.Equal(t, moteB, nextHop)
+	assert.Equal(t, []byte{PAGE_ONE_DISPATCH, 0x93, 0x05, 0x01}, lowpan[:4])
+
+	nextHop, lowpan, err = EncodeDownstream([][]byte{rootId[:], moteA, moteB}, pkt)
+	assert.Nil(t, err)
+	assert.Equal(t, moteA, nextHop)
+	assert.Equal(t, []byte{PAGE_ONE_DISPATCH, 0x80, 0x03}, lowpan[:3])
+	assert.Equal(t, moteB, lowpan[3:11])
+	assert.Equal(t, []byte{0x93, 0x05, 0x01}, lowpan[11:14])
+	assert.Equal(t, pkt.Payload, lowpan[len(lowpan)-4:])
+
+	_, _, err = EncodeDownstream([][]byte{rootId[:]}, pkt)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,110 @@
+package router
+
+// Events for changes to the routing table, for use by other components.
+
+import (
+	"github.com/kb2ma/daghead/internal/log"
+)
+
+// Provides a common type for event type constants
+type EventType int
+
+// Event types
+const (
+	// link from parent to node expired; removes node and its subtree
+	EVENT_ROUTE_EXPIRED EventType = iota + 1
+	// node moved with its subtree from OldParentId to ParentId
+	EVENT_PARENT_CHANGED
+	// node restarted its DAOSequence, as after a reboot
+	EVENT_MOTE_RESET
+	// link from parent to node removed by a No-Path DAO, with any nodes left
+	// unreachable
+	EVENT_ROUTE_REMOVED
+	// link from parent to node rejected because it would create a loop; or, with
+	// no parent, a loop reported by the data path for packets from node
+	EVENT_LOOP_DETECTED
+	// rank of node inconsistent with its parent, or with its depth in the
+	// routing table; ParentId is the preferred parent
+	EVENT_RANK_INCONSISTENT
+	// routing table reset for a new DODAG version; node is the root
+	EVENT_GLOBAL_REPAIR
+)
+
+// A change to the routing table
+type Event struct {
+	Type EventType
+	// DODAG of the routing table
+	Dodag DodagKey
+	NodeId []byte
+	ParentId []byte
+	OldParentId []byte
+	// IDs of all nodes removed from the routing table, if any
+	Removed [][]byte
+}
+
+var (
+	eventHandler func(Event)
+	// Events generated while the routing table is locked, to emit after unlock
+	pendingEvents []Event
+)
+
+/*
+Sets the function to handle routing table events. The handler is called after
+the routing table has been updated, and so may call back into this package.
+*/
+func SetEventHandler(handler func(Event)) {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	eventHandler = handler
+}
+
+func (t EventType) String() string {
+	switch t {
+	case EVENT_ROUTE_EXPIRED:
+		return "route expired"
+	case EVENT_PARENT_CHANGED:
+		return "parent changed"
+	case EVENT_MOTE_RESET:
+		return "mote reset"
+	case EVENT_ROUTE_REMOVED:
+		return "route removed"
+	case EVENT_LOOP_DETECTED:
+		return "loop detected"
+	case EVENT_RANK_INCONSISTENT:
+		return "rank inconsistent"
+	case EVENT_GLOBAL_REPAIR:
+		return "global repair"
+	default:
+		return "unknown"
+	}
+}
+
+// Queues an event for this router's DODAG while the routing table is locked
+func (r *Router) queueEvent(event Event) {
+	event.Dodag = r.key
+	pendingEvents = append(pendingEvents, event)
+}
+
+// Removes queued events for emitting; routing table must be locked
+func takeEvents() []Event {
+	events := pendingEvents
+	pendingEvents = nil
+	return events
+}
+
+// Logs each event and passes it to the event handler. The routing table must
+// not be locked.
+func emitEvents(events []Event) {
+	tableLock.Lock()
+	handler := eventHandler
+	tableLock.Unlock()
+
+	for _, event := range events {
+		log.Printf(log.INFO, "Event %s for [% X] in instance %d, parent [% X], removed %d nodes\n",
+		           event.Type, event.NodeId, event.Dodag.InstanceId, event.ParentId,
+		           len(event.Removed))
+		if handler != nil {
+			handler(event)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package router
+
+// Reads ICMPv6 messages from the mesh, and dispatches them on type.
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kb2ma/daghead/internal/log"
+)
+
+const (
+	ICMPv6_TYPE_DEST_UNREACHABLE byte = 1
+	ICMPv6_TYPE_PACKET_TOO_BIG   byte = 2
+	ICMPv6_TYPE_TIME_EXCEEDED    byte = 3
+	ICMPv6_TYPE_PARAM_PROBLEM    byte = 4
+	ICMPv6_TYPE_ECHO_REQUEST     byte = 128
+	ICMPv6_TYPE_ECHO_REPLY       byte = 129
+	ICMPv6_TYPE_RPL              byte = 155
+
+	ICMPv6_HEADER_LEN int = 4
+)
+
+/*
+Reads an ICMPv6 message, which follows the IP header described by ip. Records
+the ICMPv6 header in ip.Fields, and dispatches on message type. Expects the
+checksum already has been verified.
+
+Returns an error for a message type that is not supported, or for a message
+that can't be read.
+*/
+func ReadIcmpv6(ip *IpData, data []byte) error {
+	if len(data) < ICMPv6_HEADER_LEN {
+		return errors.New(fmt.Sprintf("ICMPv6 message too short %d", len(data)))
+	}
+	msgType := data[0]
+	code := data[1]
+	ip.Fields["icmpv6_type"] = int(msgType)
+	ip.Fields["icmpv6_code"] = int(code)
+	ip.Fields["icmpv6_checksum"] = (int(data[2]) << 8) + int(data[3])
+	body := data[ICMPv6_HEADER_LEN:]
+
+	switch msgType {
+	case ICMPv6_TYPE_RPL:
+		return ReadRpl(ip, code, body)
+	case ICMPv6_TYPE_ECHO_REQUEST, ICMPv6_TYPE_ECHO_REPLY:
+		if code != 0 {
+			return errors.New(fmt.Sprintf("invalid ICMPv6 echo code %d", code))
+		}
+		log.Printf(log.INFO, "ICMPv6 echo type %d from [% X]\n", msgType, ip.Source[8:])
+		return nil
+	case ICMPv6_TYPE_DEST_UNREACHABLE:
+		return readDestUnreachable(ip, code, body)
+	case ICMPv6_TYPE_PACKET_TOO_BIG, ICMPv6_TYPE_TIME_EXCEEDED, ICMPv6_TYPE_PARAM_PROBLEM:
+		log.Printf(log.ERROR, "ICMPv6 error type %d, code %d from [% X]\n", msgType, code,
+		           ip.Source[8:])
+		return nil
+	default:
+		return errors.New(fmt.Sprintf("unsupported ICMPv6 type %d from [% X]", msgType,
+		                              ip.Source[8:]))
+	}
+}
@@ -0,0 +1,197 @@
+package router
+
+/*
+RPL Instances and DODAGs managed by daghead. Each DODAG, identified by its RPL
+Instance ID and DODAGID, has a separate Router with its own routing table, so
+several logical topologies may be managed at once. All of the DODAGs are rooted
+at the root mote.
+
+All router state is guarded by tableLock, so exported functions and methods are
+safe for use from multiple goroutines. Read the routing table with Snapshot().
+*/
+
+import (
+	"github.com/kb2ma/daghead/internal/log"
+	"sync"
+)
+
+// RPL Instance ID when a packet does not include one, as when elided from the RPI
+const DEFAULT_INSTANCE_ID byte = 0
+
+// Identifies a DODAG
+type DodagKey struct {
+	InstanceId byte
+	DodagId [16]byte
+}
+
+// Routing table and related state for a DODAG
+type Router struct {
+	key DodagKey
+	// nil until the root mote is known
+	rootNode *RplNode
+	// All nodes in the routing table, including the root, keyed by EUI-64
+	nodes map[Eui64]*RplNode
+	// Seconds per unit of a DAO Path Lifetime; learned from a DIO DODAG Configuration
+	lifetimeUnit int
+	// Also learned from a DIO DODAG Configuration
+	minHopRankIncrease int
+	// DODAG Version Number from a DIO or a global repair, or NO_SEQUENCE
+	version int
+	// Links waiting for their parent to be added to the routing table
+	pendingLinks []*PendingLink
+	// Source routes computed since the last change to the routing table, keyed by
+	// EUI-64 of the destination
+	routeCache map[Eui64][][]byte
+	// DAO-ACKs not yet sent, oldest first
+	daoAcks []*DaoAck
+	// Mode of Operation
+	mop byte
+	// Routes through children of the root, in storing mode
+	nextHops map[targetKey]*NextHopRoute
+	// Projected routes, in the order created
+	tracks []*ProjectedRoute
+	// DAOSequence for the next P-DAO
+	pdaoSequence byte
+}
+
+var (
+	// All routers, in the order created
+	routers []*Router
+	// ID of the root mote, or nil until known
+	rootMoteId []byte
+	// Seconds per unit of a DAO Path Lifetime for a new router
+	defaultLifetimeUnit = DEFAULT_LIFETIME_UNIT
+	// Guards all routers, which are updated from reading DAOs and from the route
+	// sweeper
+	tableLock sync.Mutex
+)
+
+/*
+Sets the ID of the root mote. Resets the routing table for each DODAG already
+known with the new root node, and attaches any links already pending for it.
+Also creates the router for the default RPL Instance, with the root mote's
+address as DODAGID, if not known. Then restores any saved routing tables for
+the root.
+
+Returns the router for the default instance.
+*/
+func InitRootNode(id [8]byte) *Router {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	rootMoteId = make([]byte, len(id))
+	copy(rootMoteId, id[:])
+
+	var zeroId [16]byte
+	for _, r := range routers {
+		// DODAGID was not known when created
+		if r.key.DodagId == zeroId {
+			r.key.DodagId = NodeAddress(rootMoteId)
+		}
+		r.setRoot()
+	}
+	rootAddr := NodeAddress(rootMoteId)
+	r := getRouter(DEFAULT_INSTANCE_ID, &rootAddr)
+	restoreTables()
+	return r
+}
+
+// Returns a copy of the ID of the root mote, or nil if not known
+func RootId() []byte {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	if rootMoteId == nil {
+		return nil
+	}
+	return append([]byte{}, rootMoteId...)
+}
+
+// Creates a router for the DODAG, with a root node if the root mote is known
+func newRouter(key DodagKey) *Router {
+	r := &Router{key: key, lifetimeUnit: defaultLifetimeUnit,
+	             minHopRankIncrease: DEFAULT_MIN_HOP_RANK_INCREASE, version: NO_SEQUENCE,
+	             mop: defaultMop, pdaoSequence: SEQUENCE_INIT}
+	routers = append(routers, r)
+	log.Printf(log.INFO, "Created router for instance %d, DODAG [% X]\n", key.InstanceId,
+	           key.DodagId)
+	if rootMoteId != nil {
+		r.setRoot()
+	}
+	return r
+}
+
+// Returns the key for the router's DODAG. The DODAGID may be updated once, when
+// the root mote is known.
+func (r *Router) Key() DodagKey {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	return r.key
+}
+
+/*
+Creates the root node, and attaches any links already pending for it. Also
+clears the next-hop table. Keeps the Tracks, since the ingress motes still have
+them, so their TrackIDs are not reused. A Track is active again once the links
+along its path return.
+*/
+func (r *Router) setRoot() {
+	r.rootNode = newNode(rootMoteId)
+	r.nodes = map[Eui64]*RplNode{r.rootNode.key: r.rootNode}
+	r.nextHops = nil
+	r.invalidateRoutes()
+	log.Printf(log.INFO, "Created root node [% X] for instance %d\n", rootMoteId,
+	           r.key.InstanceId)
+	r.attachStatic(r.rootNode)
+	r.attachPending(r.rootNode)
+}
+
+/*
+Finds the router for the RPL Instance and DODAGID. If dodagId is nil, as for a
+packet with only an RPI, finds the first router created for the instance.
+Returns nil if not found.
+*/
+func FindRouter(instanceId byte, dodagId *[16]byte) *Router {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	return findRouter(instanceId, dodagId)
+}
+
+// Finds the router for the instance and DODAG; the routers must be locked
+func findRouter(instanceId byte, dodagId *[16]byte) *Router {
+	for _, r := range routers {
+		if (r.key.InstanceId == instanceId) &&
+		   ((dodagId == nil) || (r.key.DodagId == *dodagId)) {
+			return r
+		}
+	}
+	return nil
+}
+
+/*
+Finds the router for the instance and DODAG, and creates it if not found. If
+dodagId is nil, a new router uses the root mote's address, or a zero DODAGID
+until the root is known. The routers must be locked.
+*/
+func getRouter(instanceId byte, dodagId *[16]byte) *Router {
+	if r := findRouter(instanceId, dodagId); r != nil {
+		return r
+	}
+	key := DodagKey{InstanceId: instanceId}
+	if dodagId != nil {
+		key.DodagId = *dodagId
+	} else if rootMoteId != nil {
+		key.DodagId = NodeAddress(rootMoteId)
+	}
+	return newRouter(key)
+}
+
+// Returns the router for the default RPL Instance, or nil if not known
+func DefaultRouter() *Router {
+	return FindRouter(DEFAULT_INSTANCE_ID, nil)
+}
+
+// Returns all of the routers, in the order created
+func Routers() []*Router {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	return append([]*Router{}, routers...)
+}
@@ -0,0 +1,53 @@
+package router
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+// Tests DAOs for separate RPL Instances update separate routing tables
+func TestMultipleInstances(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	assert.Equal(t, r, DefaultRouter())
+	assert.Equal(t, DEFAULT_INSTANCE_ID, r.Key().InstanceId)
+	var events []Event
+	SetEventHandler(func(event Event) {
+		events = append(events, event)
+	})
+
+	// DAO base object at dao[4], with DODAGID
+	dao := make([]byte, len(data)-23)
+	copy(dao, data[23:])
+	dao[4] = 1
+	ip := &IpData{Fields: make(map[string]int)}
+	copy(ip.Source[8:], moteA)
+	assert.Nil(t, ReadIcmpv6(ip, dao))
+
+	var dodagId [16]byte
+	copy(dodagId[:], dao[8:24])
+	r1 := FindRouter(1, &dodagId)
+	assert.NotNil(t, r1)
+	assert.Equal(t, r1, FindRouter(1, nil))
+	assert.NotEqual(t, r, r1)
+	_, ok := r1.findNode(moteA)
+	assert.True(t, ok)
+	_, ok = r.findNode(moteA)
+	assert.False(t, ok)
+	route, err := r1.SourceRoute(moteA)
+	assert.Nil(t, err)
+	assert.Equal(t, rootId[:], route[0])
+
+	// other DODAG in the same instance
+	dodagId[15] ^= 0xFF
+	assert.Nil(t, FindRouter(1, &dodagId))
+
+	r1.ReportLoop(moteA)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, byte(1), events[0].Dodag.InstanceId)
+
+	// new root resets all tables
+	InitRootNode(rootId)
+	_, ok = r1.findNode(moteA)
+	assert.False(t, ok)
+}
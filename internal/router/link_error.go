@@ -0,0 +1,168 @@
+package router
+
+/*
+Errors for links in source routes, reported by ICMPv6 errors from motes. When a
+mote can't forward a source routed packet to the next hop, it returns a
+Destination Unreachable error to the root. The link from the mote to its child
+toward the destination then is suspect, and is avoided when selecting a route.
+A link is removed after the error limit. A DAO from the child with a newer Path
+Sequence clears the errors for the link, so errors spread over a long time do
+not remove it.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/kb2ma/daghead/internal/log"
+)
+
+const (
+	// RFC 4443 sec. 3.1
+	ICMPv6_CODE_ADDR_UNREACHABLE byte = 3
+	// RFC 6554 sec. 5; Error in Source Routing Header
+	ICMPv6_CODE_SRH_ERROR byte = 7
+
+	// Default count of errors for a link before it is removed
+	DEFAULT_LINK_ERROR_LIMIT = 3
+	// Length of unused field before the invoking packet in an error message
+	ICMPv6_ERROR_UNUSED_LEN = 4
+	IPv6_HEADER_LEN = 40
+)
+
+var linkErrorLimit = DEFAULT_LINK_ERROR_LIMIT
+
+// Sets the count of errors for a link before it is removed
+func SetLinkErrorLimit(limit int) {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	linkErrorLimit = limit
+}
+
+/*
+Reads the body of a Destination Unreachable message from the mote at ip.Source,
+and reports a link error for the route to the destination of the invoking
+packet. The body starts with the unused field, followed by as much of the
+invoking packet as fits, starting with its IPv6 header. The router is the one
+for the RPL Instance in the RPI of the error packet.
+
+Codes other than address unreachable and source routing errors do not indicate
+a bad link, so are only logged.
+*/
+func readDestUnreachable(ip *IpData, code byte, body []byte) error {
+	if (code != ICMPv6_CODE_ADDR_UNREACHABLE) && (code != ICMPv6_CODE_SRH_ERROR) {
+		log.Printf(log.ERROR, "ICMPv6 destination unreachable, code %d from [% X]\n", code,
+		           ip.Source[8:])
+		return nil
+	}
+	if len(body) < ICMPv6_ERROR_UNUSED_LEN + IPv6_HEADER_LEN {
+		return errors.New(fmt.Sprintf("invoking packet too short in error from [% X]",
+		                              ip.Source[8:]))
+	}
+	invoking := body[ICMPv6_ERROR_UNUSED_LEN:]
+	if (invoking[0] >> 4) != 6 {
+		return errors.New(fmt.Sprintf("invoking packet not IPv6 in error from [% X]",
+		                              ip.Source[8:]))
+	}
+	var dest [16]byte
+	copy(dest[:], invoking[24:40])
+	ip.Fields["error_code"] = int(code)
+	log.Printf(log.WARN, "Mote [% X] can't forward to [% X], code %d\n", ip.Source[8:],
+	           dest[8:], code)
+	r := FindRouter(byte(ip.Fields["hop_rplInstanceID"]), nil)
+	if r == nil {
+		return errors.New(fmt.Sprintf("no router for instance %d",
+		                              ip.Fields["hop_rplInstanceID"]))
+	}
+	return r.ReportLinkError(ip.Source[8:], dest[8:])
+}
+
+/*
+Reports an error from the mote for reporterId while forwarding a packet to the
+mote for destId. Matches the error to the link from the reporter to its child
+toward the destination. The packet may have taken a route other than the
+current one, as after an earlier error made a link suspect, so the link need
+not be on the current route. Marks the link suspect, and removes it at the
+error limit, with any nodes left unreachable. A removal emits an
+EVENT_ROUTE_REMOVED.
+
+Returns an error if the destination is not below the reporter.
+*/
+func (r *Router) ReportLinkError(reporterId []byte, destId []byte) error {
+	tableLock.Lock()
+	err := r.reportLinkError(reporterId, destId)
+	events := takeEvents()
+	tableLock.Unlock()
+
+	emitEvents(events)
+	return err
+}
+
+// Reports an error for the link from the reporter; the routing table must be locked
+func (r *Router) reportLinkError(reporterId []byte, destId []byte) error {
+	parent, okParent := r.findNode(reporterId)
+	dest, okDest := r.findNode(destId)
+	if !okParent || !okDest {
+		return ErrUnknownDestination
+	}
+	link := r.errorLink(parent, dest)
+	if link == nil {
+		return errors.New(fmt.Sprintf("[% X] not below reporter [% X]", destId, reporterId))
+	}
+	child := link.Child
+	link.ErrorCount++
+	link.Suspect = true
+	r.invalidateRoutes()
+	log.Printf(log.WARN, "Link [% X] -> [% X] suspect, %d errors\n", parent.Id, child.Id,
+	           link.ErrorCount)
+
+	// a static link stays suspect, since it is configured
+	if (link.ErrorCount >= linkErrorLimit) && !link.Static {
+		r.removeLink(link)
+		log.Printf(log.WARN, "Removed link [% X] -> [% X] after %d errors\n", parent.Id,
+		           child.Id, link.ErrorCount)
+		r.queueEvent(Event{Type: EVENT_ROUTE_REMOVED, NodeId: child.Id, ParentId: parent.Id,
+		                   Removed: r.pruneUnreachable(child)})
+	}
+	return nil
+}
+
+/*
+Returns the link from parent to its child toward dest, which is the child or
+below it, or nil if none. If more than one child leads to dest, prefers the
+child on the current route to dest, and then the most preferred link.
+*/
+func (r *Router) errorLink(parent *RplNode, dest *RplNode) *RplLink {
+	var candidates []*RplLink
+	for _, child := range parent.children {
+		if isDescendant(dest, child) {
+			candidates = append(candidates, child.findLink(parent))
+		}
+	}
+	if len(candidates) <= 1 {
+		if len(candidates) == 0 {
+			return nil
+		}
+		return candidates[0]
+	}
+
+	if route, err := r.sourceRoute(dest.Id); err == nil {
+		for i := 1; i < len(route); i++ {
+			if !bytes.Equal(route[i-1], parent.Id) {
+				continue
+			}
+			for _, link := range candidates {
+				if bytes.Equal(link.Child.Id, route[i]) {
+					return link
+				}
+			}
+		}
+	}
+	found := candidates[0]
+	for _, link := range candidates[1:] {
+		if link.PathControl > found.PathControl {
+			found = link
+		}
+	}
+	return found
+}
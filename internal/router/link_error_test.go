@@ -0,0 +1,142 @@
+package router
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+// Builds a Destination Unreachable message for an invoking packet to dest
+func destUnreachable(code byte, dest []byte) []byte {
+	msg := make([]byte, ICMPv6_HEADER_LEN + ICMPv6_ERROR_UNUSED_LEN + IPv6_HEADER_LEN)
+	msg[0] = ICMPv6_TYPE_DEST_UNREACHABLE
+	msg[1] = code
+	invoking := msg[ICMPv6_HEADER_LEN + ICMPv6_ERROR_UNUSED_LEN:]
+	invoking[0] = 0x60
+	addr := NodeAddress(dest)
+	copy(invoking[24:], addr[:])
+	return msg
+}
+
+// Tests a link error marks the link suspect, so the route avoids it, and then
+// removes the link at the limit
+func TestLinkError(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	var events []Event
+	SetEventHandler(func(event Event) {
+		events = append(events, event)
+	})
+	SetLinkErrorLimit(2)
+
+	updateLink(r, rootId[:], moteA, 1, 0xFF)
+	updateLink(r, rootId[:], moteC, 1, 0xFF)
+	r.updateLinks(moteB, []linkUpdate{{parentId: moteA, pathControl: 0x80, pathSequence: 1,
+	                                   lifetime: 0xFF},
+	                                  {parentId: moteC, pathControl: 0x40, pathSequence: 1,
+	                                   lifetime: 0xFF}})
+	route, _ := r.SourceRoute(moteB)
+	assert.Equal(t, [][]byte{rootId[:], moteA, moteB}, route)
+
+	ip := &IpData{Fields: make(map[string]int)}
+	copy(ip.Source[8:], moteA)
+	assert.Nil(t, ReadIcmpv6(ip, destUnreachable(ICMPv6_CODE_SRH_ERROR, moteB)))
+	b, _ := r.findNode(moteB)
+	a, _ := r.findNode(moteA)
+	link := b.findLink(a)
+	assert.True(t, link.Suspect)
+	assert.Equal(t, 1, link.ErrorCount)
+	route, _ = r.SourceRoute(moteB)
+	assert.Equal(t, [][]byte{rootId[:], moteC, moteB}, route)
+
+	// both links suspect, so route falls back to preferred parent
+	copy(ip.Source[8:], moteC)
+	assert.Nil(t, ReadIcmpv6(ip, destUnreachable(ICMPv6_CODE_ADDR_UNREACHABLE, moteB)))
+	route, _ = r.SourceRoute(moteB)
+	assert.Equal(t, [][]byte{rootId[:], moteA, moteB}, route)
+
+	// second error from moteA reaches the limit
+	copy(ip.Source[8:], moteA)
+	assert.Nil(t, ReadIcmpv6(ip, destUnreachable(ICMPv6_CODE_SRH_ERROR, moteB)))
+	assert.Nil(t, b.findLink(a))
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, EVENT_ROUTE_REMOVED, events[0].Type)
+	assert.Equal(t, 0, len(events[0].Removed))
+	route, _ = r.SourceRoute(moteB)
+	assert.Equal(t, [][]byte{rootId[:], moteC, moteB}, route)
+
+	// other codes only logged; short invoking packet rejected
+	assert.Nil(t, ReadIcmpv6(ip, destUnreachable(0, moteB)))
+	assert.NotNil(t, ReadIcmpv6(ip, destUnreachable(ICMPv6_CODE_SRH_ERROR, moteB)[:20]))
+}
+
+// Tests repeated errors for a link reach the limit after the route moves away from it
+func TestLinkErrorAfterReroute(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	SetLinkErrorLimit(3)
+	updateLink(r, rootId[:], moteA, 1, 0xFF)
+	updateLink(r, rootId[:], moteC, 1, 0xFF)
+	r.updateLinks(moteB, []linkUpdate{{parentId: moteA, pathControl: 0x80, pathSequence: 1,
+	                                   lifetime: 0xFF},
+	                                  {parentId: moteC, pathControl: 0x40, pathSequence: 1,
+	                                   lifetime: 0xFF}})
+	updateLink(r, moteB, moteD, 1, 0xFF)
+
+	// packets in flight through A, after the first error moves the route to C
+	ip := &IpData{Fields: make(map[string]int)}
+	copy(ip.Source[8:], moteA)
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, ReadIcmpv6(ip, destUnreachable(ICMPv6_CODE_SRH_ERROR, moteD)))
+		route, _ := r.SourceRoute(moteD)
+		assert.Equal(t, [][]byte{rootId[:], moteC, moteB, moteD}, route)
+	}
+	a, _ := r.findNode(moteA)
+	b, _ := r.findNode(moteB)
+	assert.Equal(t, 2, b.findLink(a).ErrorCount)
+	assert.Nil(t, ReadIcmpv6(ip, destUnreachable(ICMPv6_CODE_SRH_ERROR, moteB)))
+	assert.Nil(t, b.findLink(a))
+	takeEvents()
+
+	// destination not below the reporter
+	assert.NotNil(t, ReadIcmpv6(ip, destUnreachable(ICMPv6_CODE_SRH_ERROR, moteC)))
+}
+
+// Tests a DAO with a newer Path Sequence clears the errors for the links it refreshes
+func TestLinkErrorCleared(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	SetLinkErrorLimit(2)
+	updateLink(r, rootId[:], moteA, 1, 0xFF)
+	updateLink(r, rootId[:], moteC, 1, 0xFF)
+	r.updateLinks(moteB, []linkUpdate{{parentId: moteA, pathControl: 0x80, pathSequence: 1,
+	                                   lifetime: 0xFF},
+	                                  {parentId: moteC, pathControl: 0x40, pathSequence: 1,
+	                                   lifetime: 0xFF}})
+
+	ip := &IpData{Fields: make(map[string]int)}
+	copy(ip.Source[8:], moteA)
+	assert.Nil(t, ReadIcmpv6(ip, destUnreachable(ICMPv6_CODE_SRH_ERROR, moteB)))
+	route, _ := r.SourceRoute(moteB)
+	assert.Equal(t, moteC, route[1])
+
+	// same Path Sequence does not clear
+	updates := []linkUpdate{{parentId: moteA, pathControl: 0x80, pathSequence: 1,
+	                         lifetime: 0xFF},
+	                        {parentId: moteC, pathControl: 0x40, pathSequence: 1,
+	                         lifetime: 0xFF}}
+	r.updateLinks(moteB, updates)
+	a, _ := r.findNode(moteA)
+	b, _ := r.findNode(moteB)
+	assert.True(t, b.findLink(a).Suspect)
+
+	// newer Path Sequence clears, so a later error does not reach the limit
+	updates[0].pathSequence, updates[1].pathSequence = 2, 2
+	r.updateLinks(moteB, updates)
+	assert.False(t, b.findLink(a).Suspect)
+	assert.Equal(t, 0, b.findLink(a).ErrorCount)
+	route, _ = r.SourceRoute(moteB)
+	assert.Equal(t, moteA, route[1])
+	assert.Nil(t, ReadIcmpv6(ip, destUnreachable(ICMPv6_CODE_SRH_ERROR, moteB)))
+	assert.NotNil(t, b.findLink(a))
+	takeEvents()
+}
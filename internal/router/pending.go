@@ -0,0 +1,142 @@
+package router
+
+/*
+Links from a DAO whose parent is not yet in the routing table. During network
+formation a child's DAO may arrive before its parent's DAO, and all DAOs may
+arrive before the root node is known. A pending link is attached when its
+parent is added, or dropped when it times out.
+*/
+
+import (
+	"bytes"
+	"github.com/kb2ma/daghead/internal/log"
+	"time"
+)
+
+const DEFAULT_PENDING_TIMEOUT = 5 * time.Minute
+
+// Link waiting for its parent to be added to the routing table
+type PendingLink struct {
+	ParentId []byte
+	ChildId []byte
+	Received time.Time
+	update linkUpdate
+}
+
+// Time to wait for the parent of a pending link
+var pendingTimeout = DEFAULT_PENDING_TIMEOUT
+
+// Sets the time to wait for the parent of a pending link before dropping it
+func SetPendingTimeout(timeout time.Duration) {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	pendingTimeout = timeout
+}
+
+// Returns a copy of the links waiting for their parent
+func (r *Router) PendingLinks() []PendingLink {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	links := make([]PendingLink, len(r.pendingLinks))
+	for i, pending := range r.pendingLinks {
+		links[i] = *pending
+	}
+	return links
+}
+
+// Adds a link for child to wait for its parent. Replaces any link pending for the
+// same parent and child.
+func (r *Router) addPending(childId []byte, update linkUpdate) {
+	r.removePending(childId, update.parentId)
+	pending := &PendingLink{ParentId: make([]byte, len(update.parentId)),
+	                        ChildId: make([]byte, len(childId)), Received: time.Now(),
+	                        update: update}
+	copy(pending.ParentId, update.parentId)
+	copy(pending.ChildId, childId)
+	pending.update.parentId = pending.ParentId
+	r.pendingLinks = append(r.pendingLinks, pending)
+	log.Printf(log.INFO, "pending parent [% X] -> child [% X]; %d links pending\n",
+	           pending.ParentId, pending.ChildId, len(r.pendingLinks))
+}
+
+// Removes links pending for child, and for parentId if not nil
+func (r *Router) removePending(childId []byte, parentId []byte) {
+	kept := r.pendingLinks[:0]
+	for _, pending := range r.pendingLinks {
+		if bytes.Equal(pending.ChildId, childId) &&
+		   ((parentId == nil) || bytes.Equal(pending.ParentId, parentId)) {
+			continue
+		}
+		kept = append(kept, pending)
+	}
+	r.pendingLinks = kept
+}
+
+/*
+Attaches the links pending for parent, which just was added to the routing
+table. A child added this way may be the parent for other pending links, so
+also attaches those.
+*/
+func (r *Router) attachPending(parent *RplNode) {
+	added := []*RplNode{parent}
+	for len(added) > 0 {
+		p := added[0]
+		added = added[1:]
+
+		var ready []*PendingLink
+		kept := r.pendingLinks[:0]
+		for _, pending := range r.pendingLinks {
+			if isNodeId(p, pending.ParentId) {
+				ready = append(ready, pending)
+			} else {
+				kept = append(kept, pending)
+			}
+		}
+		r.pendingLinks = kept
+
+		for _, pending := range ready {
+			child, isKnown := r.findNode(pending.ChildId)
+			if !isKnown {
+				child = newNode(pending.ChildId)
+				child.pathSequence = int(pending.update.pathSequence)
+				r.nodes[child.key] = child
+				added = append(added, child)
+			} else if child.hasStaticParent() {
+				log.Printf(log.DEBUG, "Keeping static parents for child [% X]\n", child.Id)
+				continue
+			} else if isDescendant(p, child) {
+				r.rejectLoop(child, p)
+				continue
+			}
+			link := child.findLink(p)
+			if link == nil {
+				link = &RplLink{Parent: p, Child: child}
+				p.children = append(p.children, child)
+				child.parents = append(child.parents, link)
+			}
+			link.PathControl = pending.update.pathControl
+			link.setLifetime(pending.update.lifetime, r.lifetimeUnit)
+			sortParents(child)
+			r.invalidateRoutes()
+			log.Printf(log.INFO, "attached pending parent [% X] -> child [% X]\n", p.Id,
+			           child.Id)
+			if !isKnown {
+				r.attachStatic(child)
+			}
+		}
+	}
+}
+
+// Drops links that have been pending since before the timeout
+func (r *Router) expirePending(now time.Time) {
+	kept := r.pendingLinks[:0]
+	for _, pending := range r.pendingLinks {
+		if now.Sub(pending.Received) >= pendingTimeout {
+			log.Printf(log.WARN, "Dropped pending parent [% X] -> child [% X]\n",
+			           pending.ParentId, pending.ChildId)
+		} else {
+			kept = append(kept, pending)
+		}
+	}
+	r.pendingLinks = kept
+}
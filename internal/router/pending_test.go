@@ -0,0 +1,48 @@
+package router
+
+import (
+  "testing"
+  "time"
+  "github.com/stretchr/testify/assert"
+)
+
+// Tests links pending before the root node is known, and before a parent is known
+func TestAttachPending(t *testing.T) {
+	resetRouters(t)
+	r := getRouter(DEFAULT_INSTANCE_ID, nil)
+	assert.Nil(t, r.rootNode)
+
+	updateLink(r, moteA, moteB, 1, 0xFF)
+	updateLink(r, rootId[:], moteA, 1, 0xFF)
+	pending := r.PendingLinks()
+	assert.Equal(t, 2, len(pending))
+	assert.Equal(t, moteB, pending[0].ChildId)
+	assert.Equal(t, moteA, pending[0].ParentId)
+
+	// root attaches A, which attaches B; the router is the same
+	assert.Equal(t, r, InitRootNode(rootId))
+	assert.Equal(t, NodeAddress(rootId[:]), r.Key().DodagId)
+	assert.Equal(t, 0, len(r.PendingLinks()))
+	route, ok := r.selectRoute(moteB)
+	assert.True(t, ok)
+	assert.Equal(t, [][]byte{rootId[:], moteA, moteB}, route)
+
+	// C waits for B; a new DAO from C replaces the pending link
+	updateLink(r, moteD, moteC, 1, 0xFF)
+	updateLink(r, moteB, moteC, 2, 0xFF)
+	assert.Equal(t, 0, len(r.PendingLinks()))
+	takeEvents()
+}
+
+func TestExpirePending(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	r.pendingLinks = nil
+	SetPendingTimeout(time.Minute)
+
+	updateLink(r, moteA, moteB, 1, 0xFF)
+	ExpireRoutes(time.Now())
+	assert.Equal(t, 1, len(r.PendingLinks()))
+	ExpireRoutes(time.Now().Add(2 * time.Minute))
+	assert.Equal(t, 0, len(r.PendingLinks()))
+}
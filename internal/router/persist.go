@@ -0,0 +1,300 @@
+package router
+
+/*
+Saves the routing tables to restore them after a restart, so downstream routing
+works before each mote sends its next DAO. A table is restored when the root
+mote is known, if the saved root is the same mote. The restored links and routes
+are marked Stale, but are usable. A DAO that refreshes a link or route clears
+the mark.
+
+Saves the nodes, links, prefix and next-hop routes, and their sequences and
+lifetimes. A restored link or route keeps its saved expiry. Also saves the
+Tracks, since the ingress motes still have them, so their TrackIDs are not
+reused. Does not save links still pending, or static links, which are
+configured.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kb2ma/daghead/internal/log"
+	"io"
+	"time"
+)
+
+// Saved routing table for a DODAG
+type savedTable struct {
+	InstanceId byte
+	DodagId [16]byte
+	RootId []byte
+	Version int
+	LifetimeUnit int
+	Mop byte
+	Nodes []savedNode
+	NextHops []savedRoute
+	Tracks []savedTrack
+	// DAOSequence for the next P-DAO
+	PdaoSequence byte
+	Saved time.Time
+}
+
+// Saved node, other than the root
+type savedNode struct {
+	Id []byte
+	DaoSequence int
+	PathSequence int
+	Parents []savedLink
+	Prefixes []savedRoute
+}
+
+type savedLink struct {
+	ParentId []byte
+	PathControl byte
+	Lifetime byte
+	// zero if the link does not expire
+	Expires time.Time
+}
+
+// Saved prefix or next-hop route
+type savedRoute struct {
+	Prefix [16]byte
+	PrefixLen int
+	External bool
+	// only for a next-hop route
+	NextHopId []byte
+	PathSequence int
+	Lifetime byte
+	Expires time.Time
+}
+
+type savedTrack struct {
+	TrackId byte
+	Path [][]byte
+	State TrackState
+	Sequence byte
+	Lifetime byte
+	Sent time.Time
+	// zero if the Track does not expire
+	Expires time.Time
+}
+
+// Tables read to restore when the root mote is known
+var restoredTables []*savedTable
+
+// Writes the routing tables for all routers with a root node, as JSON
+func SaveTables(w io.Writer) error {
+	tableLock.Lock()
+	tables := make([]*savedTable, 0, len(routers))
+	for _, r := range routers {
+		if r.rootNode != nil {
+			tables = append(tables, r.saveTable())
+		}
+	}
+	tableLock.Unlock()
+
+	return json.NewEncoder(w).Encode(tables)
+}
+
+// Returns a copy of the routing table to save; the routing table must be locked
+func (r *Router) saveTable() *savedTable {
+	table := &savedTable{InstanceId: r.key.InstanceId, DodagId: r.key.DodagId,
+	                     RootId: copyId(r.rootNode.Id), Version: r.version,
+	                     LifetimeUnit: r.lifetimeUnit, Mop: r.mop, Saved: time.Now()}
+	for _, node := range r.nodes {
+		if node == r.rootNode {
+			continue
+		}
+		saved := savedNode{Id: copyId(node.Id), DaoSequence: node.daoSequence,
+		                   PathSequence: node.pathSequence}
+		for _, link := range node.parents {
+			if link.Static {
+				continue
+			}
+			saved.Parents = append(saved.Parents,
+			                       savedLink{ParentId: copyId(link.Parent.Id),
+			                                 PathControl: link.PathControl,
+			                                 Lifetime: link.lifetime, Expires: link.expires})
+		}
+		for _, route := range node.prefixes {
+			saved.Prefixes = append(saved.Prefixes,
+			                        savedRoute{Prefix: route.Prefix, PrefixLen: route.PrefixLen,
+			                                   External: route.External,
+			                                   Lifetime: route.lifetime, Expires: route.expires})
+		}
+		table.Nodes = append(table.Nodes, saved)
+	}
+	for _, track := range r.tracks {
+		copied := track.copy()
+		table.Tracks = append(table.Tracks,
+		                      savedTrack{TrackId: copied.TrackId, Path: copied.Path,
+		                                 State: copied.State, Sequence: copied.Sequence,
+		                                 Lifetime: copied.Lifetime, Sent: copied.Sent,
+		                                 Expires: copied.expires})
+	}
+	table.PdaoSequence = r.pdaoSequence
+	for _, route := range r.nextHops {
+		table.NextHops = append(table.NextHops,
+		                        savedRoute{Prefix: route.Prefix, PrefixLen: route.PrefixLen,
+		                                   NextHopId: copyId(route.NextHopId),
+		                                   PathSequence: route.pathSequence,
+		                                   Lifetime: route.lifetime, Expires: route.expires})
+	}
+	return table
+}
+
+/*
+Reads routing tables written by SaveTables(), to restore when the root mote is
+known. Restores them now if the root already is known.
+*/
+func RestoreTables(rd io.Reader) error {
+	var tables []*savedTable
+	if err := json.NewDecoder(rd).Decode(&tables); err != nil {
+		return errors.New(fmt.Sprintf("can't read saved routing tables: %v", err))
+	}
+	tableLock.Lock()
+	restoredTables = tables
+	if rootMoteId != nil {
+		restoreTables()
+	}
+	events := takeEvents()
+	tableLock.Unlock()
+
+	emitEvents(events)
+	return nil
+}
+
+/*
+Restores the tables read for the root mote, creating their routers as needed,
+and drops the tables. The routers must be locked.
+*/
+func restoreTables() {
+	now := time.Now()
+	for _, table := range restoredTables {
+		if !bytes.Equal(table.RootId, rootMoteId) {
+			log.Printf(log.WARN, "Not restoring instance %d; saved root [% X] is not the root\n",
+			           table.InstanceId, table.RootId)
+			continue
+		}
+		getRouter(table.InstanceId, &table.DodagId).restoreTable(table, now)
+	}
+	restoredTables = nil
+}
+
+/*
+Adds the nodes and routes from the saved table, as Stale. Does not replace a
+node or route already in the table, since it is newer, and a static link
+replaces a restored link. Skips links and routes that have expired as of now.
+Restores the lifetime unit only if the router still uses the default. The
+routing table must be locked.
+*/
+func (r *Router) restoreTable(table *savedTable, now time.Time) {
+	if r.version == NO_SEQUENCE {
+		r.version = table.Version
+	}
+	if mopFromDio {
+		r.mop = table.Mop
+	}
+	// not if configured or learned from a DIO; zero would expire every route
+	if r.lifetimeUnit == DEFAULT_LIFETIME_UNIT {
+		r.setLifetimeUnit(table.LifetimeUnit)
+	}
+
+	var added []*RplNode
+	var addedSaved []*savedNode
+	for i, saved := range table.Nodes {
+		if _, ok := r.findNode(saved.Id); ok {
+			continue
+		}
+		node := newNode(saved.Id)
+		node.daoSequence = saved.DaoSequence
+		node.pathSequence = saved.PathSequence
+		for _, savedPrefix := range saved.Prefixes {
+			if isExpired(savedPrefix.Expires, now) {
+				continue
+			}
+			node.prefixes = append(node.prefixes,
+			                       &PrefixRoute{Prefix: savedPrefix.Prefix,
+			                                    PrefixLen: savedPrefix.PrefixLen,
+			                                    External: savedPrefix.External,
+			                                    Stale: true, lifetime: savedPrefix.Lifetime,
+			                                    expires: savedPrefix.Expires})
+		}
+		r.nodes[node.key] = node
+		added = append(added, node)
+		addedSaved = append(addedSaved, &table.Nodes[i])
+	}
+
+	for i, child := range added {
+		for _, savedParent := range addedSaved[i].Parents {
+			parent, ok := r.findNode(savedParent.ParentId)
+			if !ok || isExpired(savedParent.Expires, now) || (child.findLink(parent) != nil) ||
+			   isDescendant(parent, child) {
+				continue
+			}
+			link := &RplLink{Parent: parent, Child: child, PathControl: savedParent.PathControl,
+			                 Stale: true, lifetime: savedParent.Lifetime,
+			                 expires: savedParent.Expires}
+			parent.children = append(parent.children, child)
+			child.parents = append(child.parents, link)
+		}
+		sortParents(child)
+	}
+
+	nextHops := 0
+	for _, savedRoute := range table.NextHops {
+		key := targetKey{prefix: savedRoute.Prefix, length: savedRoute.PrefixLen}
+		if _, ok := r.nextHops[key]; ok || isExpired(savedRoute.Expires, now) {
+			continue
+		}
+		nextHops++
+		if r.nextHops == nil {
+			r.nextHops = make(map[targetKey]*NextHopRoute)
+		}
+		r.nextHops[key] = &NextHopRoute{Prefix: savedRoute.Prefix,
+		                                PrefixLen: savedRoute.PrefixLen,
+		                                NextHopId: copyId(savedRoute.NextHopId), Stale: true,
+		                                pathSequence: savedRoute.PathSequence,
+		                                lifetime: savedRoute.Lifetime,
+		                                expires: savedRoute.Expires}
+	}
+	r.invalidateRoutes()
+
+	tracks := 0
+	for _, saved := range table.Tracks {
+		if r.findTrack(saved.TrackId) != nil || isExpired(saved.Expires, now) ||
+		   (len(saved.Path) < 2) || (len(saved.Path) - 1 > TRACK_MAX_HOPS) {
+			continue
+		}
+		tracks++
+		r.tracks = append(r.tracks, &ProjectedRoute{TrackId: saved.TrackId, Path: saved.Path,
+		                                            State: saved.State, Sequence: saved.Sequence,
+		                                            Lifetime: saved.Lifetime, Sent: saved.Sent,
+		                                            expires: saved.Expires})
+	}
+	if len(r.tracks) == tracks {
+		r.pdaoSequence = table.PdaoSequence
+	}
+
+	removed := 0
+	for _, node := range added {
+		if n, ok := r.findNode(node.Id); ok && (n == node) {
+			removed += len(r.pruneUnreachable(node))
+		}
+	}
+	for _, node := range added {
+		if n, ok := r.findNode(node.Id); ok && (n == node) {
+			r.attachStatic(node)
+			r.attachPending(node)
+		}
+	}
+	log.Printf(log.INFO, "Restored %d nodes, %d next hops and %d Tracks for instance %d, " +
+	           "saved %v\n", len(added) - removed, nextHops, tracks, r.key.InstanceId,
+	           table.Saved)
+}
+
+// Returns true if a saved expiry has passed as of now; zero does not expire
+func isExpired(expires time.Time, now time.Time) bool {
+	return !expires.IsZero() && !now.Before(expires)
+}
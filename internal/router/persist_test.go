@@ -0,0 +1,122 @@
+package router
+
+import (
+  "bytes"
+  "encoding/json"
+  "testing"
+  "time"
+  "github.com/stretchr/testify/assert"
+)
+
+// Tests saving the routing table, and restoring it as stale when the root is known
+func TestRestoreTables(t *testing.T) {
+	resetRouters(t)
+	SetLifetimeUnit(1)
+	r := InitRootNode(rootId)
+	updateLink(r, rootId[:], moteA, 1, 0xFF)
+	updateLink(r, moteA, moteB, 2, 0xFF)
+	updateLink(r, rootId[:], moteC, 1, 1)
+	prefix := [16]byte{0x20, 0x01, 0x0D, 0xB8}
+	assert.Nil(t, readPrefixDao(r, moteD, moteA, 1, prefix, 32, 0xFF))
+	var saved bytes.Buffer
+	assert.Nil(t, SaveTables(&saved))
+
+	// restored after restart, except C, which has expired
+	routers = nil
+	rootMoteId = nil
+	time.Sleep(time.Second)
+	assert.Nil(t, RestoreTables(bytes.NewReader(saved.Bytes())))
+	assert.Equal(t, 0, len(routers))
+	SetLifetimeUnit(DEFAULT_LIFETIME_UNIT)
+	r = InitRootNode(rootId)
+	route, err := r.SourceRoute(moteB)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{rootId[:], moteA, moteB}, route)
+	addr := [16]byte{0x20, 0x01, 0x0D, 0xB8, 0x00, 0x01}
+	route, err = r.SourceRouteForAddress(&addr)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{rootId[:], moteA, moteD}, route)
+	_, err = r.SourceRoute(moteC)
+	assert.Equal(t, ErrUnknownDestination, err)
+
+	snap := r.Snapshot()
+	nodeB := snap.Node(moteB)
+	assert.Equal(t, 2, nodeB.PathSequence)
+	assert.True(t, nodeB.Parents[0].Stale)
+	assert.True(t, snap.Node(moteD).Prefixes[0].Stale)
+	assert.Equal(t, 1, r.lifetimeUnit)
+
+	// refreshed by a DAO; stale sequence still ignored
+	updateLink(r, moteA, moteB, 1, 0xFF)
+	assert.True(t, r.Snapshot().Node(moteB).Parents[0].Stale)
+	updateLink(r, moteA, moteB, 3, 0xFF)
+	assert.False(t, r.Snapshot().Node(moteB).Parents[0].Stale)
+	assert.True(t, r.Snapshot().Node(moteA).Parents[0].Stale)
+
+	// not restored for a different root
+	routers = nil
+	assert.Nil(t, RestoreTables(bytes.NewReader(saved.Bytes())))
+	r = InitRootNode([8]byte{0x46, 0x1D, 0x52, 0x44, 0x7B, 0x43, 0x76, 0x79})
+	assert.Equal(t, 1, len(r.Snapshot().Nodes))
+}
+
+// Tests saving and restoring the next-hop table
+func TestRestoreNextHops(t *testing.T) {
+	resetRouters(t)
+	SetMop(MOP_STORING, false)
+	r := InitRootNode(rootId)
+	assert.Nil(t, readStoringDao(r, moteA, 1, 0xFF,
+	                             RplTarget{PrefixLen: 128, Prefix: NodeAddress(moteB)}))
+	var saved bytes.Buffer
+	assert.Nil(t, SaveTables(&saved))
+
+	// restored when the root already is known
+	routers = nil
+	r = InitRootNode(rootId)
+	assert.Nil(t, RestoreTables(&saved))
+	routes := r.NextHops()
+	assert.Equal(t, 1, len(routes))
+	assert.True(t, routes[0].Stale)
+	assert.Equal(t, moteA, routes[0].NextHopId)
+	route, err := r.SourceRoute(moteB)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{rootId[:], moteA}, route)
+
+	// stale Path Sequence still ignored
+	assert.Nil(t, readStoringDao(r, moteC, 0, 0xFF,
+	                             RplTarget{PrefixLen: 128, Prefix: NodeAddress(moteB)}))
+	assert.Equal(t, moteA, r.NextHops()[0].NextHopId)
+	assert.Nil(t, readStoringDao(r, moteC, 2, 0xFF,
+	                             RplTarget{PrefixLen: 128, Prefix: NodeAddress(moteB)}))
+	assert.False(t, r.NextHops()[0].Stale)
+	takeEvents()
+}
+
+// Tests that a saved lifetime unit does not replace a configured unit, and that a
+// saved zero is ignored
+func TestRestoreLifetimeUnit(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	r.SetLifetimeUnit(30)
+	updateLink(r, rootId[:], moteA, 1, 0xFF)
+	var saved bytes.Buffer
+	assert.Nil(t, SaveTables(&saved))
+
+	routers = nil
+	SetLifetimeUnit(60)
+	r = InitRootNode(rootId)
+	assert.Nil(t, RestoreTables(bytes.NewReader(saved.Bytes())))
+	assert.Equal(t, 60, r.lifetimeUnit)
+
+	var tables []*savedTable
+	assert.Nil(t, json.Unmarshal(saved.Bytes(), &tables))
+	tables[0].LifetimeUnit = 0
+	zeroUnit, _ := json.Marshal(tables)
+	routers = nil
+	SetLifetimeUnit(DEFAULT_LIFETIME_UNIT)
+	r = InitRootNode(rootId)
+	assert.Nil(t, RestoreTables(bytes.NewReader(zeroUnit)))
+	assert.Equal(t, DEFAULT_LIFETIME_UNIT, r.lifetimeUnit)
+	_, err := r.SourceRoute(moteA)
+	assert.Nil(t, err)
+}
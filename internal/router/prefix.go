@@ -0,0 +1,154 @@
+package router
+
+/*
+Routes to prefixes advertised in DAO Target options, other than the address of
+the advertising mote itself. A mote may act as a gateway for another prefix, or
+may have more than one address. A prefix route is attached to the advertising
+mote, so the source route to an address in the prefix is the route to that mote.
+*/
+
+import (
+	"github.com/kb2ma/daghead/internal/log"
+	"time"
+)
+
+// Prefix reachable through a mote, from a DAO Target option
+type PrefixRoute struct {
+	Prefix [16]byte
+	PrefixLen int
+	// from the Transit E flag; prefix is outside the DODAG
+	External bool
+	// restored from a saved routing table, and not yet refreshed by a DAO
+	Stale bool
+	lifetime byte
+	expires time.Time
+}
+
+/*
+Updates the prefix routes for node from a Target option and a Transit for the
+target. A Transit with a No-Path lifetime removes the route. The routing table
+must be locked.
+*/
+func (r *Router) updatePrefix(node *RplNode, target *RplTarget, transit *RplTransit) {
+	for i, route := range node.prefixes {
+		if (route.PrefixLen != target.PrefixLen) || (route.Prefix != target.Prefix) {
+			continue
+		}
+		if transit.PathLifetime == NO_PATH_LIFETIME {
+			node.prefixes = append(node.prefixes[:i], node.prefixes[i+1:]...)
+			log.Printf(log.INFO, "No-Path removed prefix [% X]/%d via [% X]\n", target.Prefix,
+			           target.PrefixLen, node.Id)
+		} else {
+			route.External = transit.External
+			route.setLifetime(transit.PathLifetime, r.lifetimeUnit)
+		}
+		return
+	}
+	if transit.PathLifetime == NO_PATH_LIFETIME {
+		return
+	}
+	route := &PrefixRoute{Prefix: target.Prefix, PrefixLen: target.PrefixLen,
+	                      External: transit.External}
+	route.setLifetime(transit.PathLifetime, r.lifetimeUnit)
+	node.prefixes = append(node.prefixes, route)
+	log.Printf(log.INFO, "added prefix [% X]/%d via [% X]\n", target.Prefix,
+	           target.PrefixLen, node.Id)
+}
+
+// Sets the lifetime of the route, and refreshes its expiry
+func (route *PrefixRoute) setLifetime(lifetime byte, unit int) {
+	route.Stale = false
+	route.lifetime = lifetime
+	route.expires = expiryTime(lifetime, unit)
+}
+
+// Returns true if the first length bits of addr match prefix
+func matchPrefix(addr *[16]byte, prefix *[16]byte, length int) bool {
+	full := length / 8
+	for i := 0; i < full; i++ {
+		if addr[i] != prefix[i] {
+			return false
+		}
+	}
+	if bits := length % 8; bits != 0 {
+		mask := byte(0xFF) << (8 - bits)
+		return (addr[full] & mask) == (prefix[full] & mask)
+	}
+	return true
+}
+
+/*
+Finds the node that reaches addr, by longest prefix match. The address of a mote
+in NETWORK_PREFIX is a /128 match for the mote. The routing table must be
+locked.
+*/
+func (r *Router) findAddress(addr *[16]byte) (*RplNode, bool) {
+	if isNetworkAddress(addr) {
+		if node, ok := r.findNode(addr[8:]); ok {
+			return node, true
+		}
+	}
+	var found *RplNode
+	longest := -1
+	for _, node := range r.nodes {
+		for _, route := range node.prefixes {
+			if (route.PrefixLen > longest) && matchPrefix(addr, &route.Prefix, route.PrefixLen) {
+				found = node
+				longest = route.PrefixLen
+			}
+		}
+	}
+	return found, found != nil
+}
+
+/*
+Returns the source route to the node that reaches addr, by longest prefix match
+on the addresses of motes and the prefixes they advertise, and then on the
+next-hop table. Otherwise the same as r.SourceRoute().
+*/
+func (r *Router) SourceRouteForAddress(addr *[16]byte) ([][]byte, error) {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	if r.rootNode == nil {
+		return nil, ErrNoRoot
+	}
+	node, ok := r.findAddress(addr)
+	if !ok {
+		if route, ok := r.nextHopRoute(addr); ok {
+			return route, nil
+		}
+		return nil, ErrUnknownDestination
+	}
+	return r.sourceRoute(node.Id)
+}
+
+// Returns a copy of the prefix routes attached to the node for id
+func (r *Router) PrefixRoutes(id []byte) []PrefixRoute {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	node, ok := r.findNode(id)
+	if !ok {
+		return nil
+	}
+	routes := make([]PrefixRoute, len(node.prefixes))
+	for i, route := range node.prefixes {
+		routes[i] = *route
+	}
+	return routes
+}
+
+// Removes prefix routes that have expired as of now
+func (r *Router) expirePrefixes(now time.Time) {
+	for _, node := range r.nodes {
+		kept := node.prefixes[:0]
+		for _, route := range node.prefixes {
+			if !route.expires.IsZero() && !now.Before(route.expires) {
+				log.Printf(log.INFO, "Expired prefix [% X]/%d via [% X]\n", route.Prefix,
+				           route.PrefixLen, node.Id)
+			} else {
+				kept = append(kept, route)
+			}
+		}
+		node.prefixes = kept
+	}
+}
@@ -0,0 +1,95 @@
+package router
+
+import (
+  "testing"
+  "time"
+  "github.com/stretchr/testify/assert"
+)
+
+// Reads a DAO from source with a Target for its own address and a prefix Target
+func readPrefixDao(r *Router, source []byte, parent []byte, sequence byte, prefix [16]byte,
+                   prefixLen int, lifetime byte) error {
+	srcAddr := NodeAddress(source)
+	transit := RplTransit{PathSequence: sequence, PathLifetime: lifetime, HasParent: true,
+	                      Parent: NodeAddress(parent)}
+	opts := &RplOptions{DaoGroups: []RplDaoGroup{{
+		Targets: []RplTarget{{PrefixLen: 128, Prefix: srcAddr},
+		                     {PrefixLen: prefixLen, Prefix: prefix}},
+		Transits: []RplTransit{transit}}}}
+	if lifetime == NO_PATH_LIFETIME {
+		// keep the link to the parent
+		transit.PathLifetime = INFINITE_LIFETIME
+		opts.DaoGroups = append([]RplDaoGroup{{Targets: []RplTarget{{PrefixLen: 128,
+		                                                            Prefix: srcAddr}},
+		                                       Transits: []RplTransit{transit}}},
+		                       RplDaoGroup{Targets: []RplTarget{{PrefixLen: prefixLen,
+		                                                         Prefix: prefix}},
+		                                   Transits: opts.DaoGroups[0].Transits})
+	}
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	err := r.readDaoOptions(&srcAddr, &RplDao{Sequence: sequence}, opts)
+	takeEvents()
+	return err
+}
+
+// Tests longest prefix match across mote addresses and advertised prefixes
+func TestPrefixRoute(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	short := [16]byte{0x20, 0x01, 0x0D, 0xB8}
+	long := [16]byte{0x20, 0x01, 0x0D, 0xB8, 0x00, 0x01}
+	assert.Nil(t, readPrefixDao(r, moteA, rootId[:], 1, short, 32, 0xFF))
+	assert.Nil(t, readPrefixDao(r, moteB, moteA, 1, long, 48, 0xFF))
+	assert.Equal(t, 1, len(r.PrefixRoutes(moteA)))
+	assert.Equal(t, 48, r.PrefixRoutes(moteB)[0].PrefixLen)
+
+	addr := [16]byte{0x20, 0x01, 0x0D, 0xB8, 0x00, 0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x05}
+	route, err := r.SourceRouteForAddress(&addr)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{rootId[:], moteA, moteB}, route)
+
+	addr[5] = 0x02
+	route, err = r.SourceRouteForAddress(&addr)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{rootId[:], moteA}, route)
+
+	addr = NodeAddress(moteB)
+	route, err = r.SourceRouteForAddress(&addr)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{rootId[:], moteA, moteB}, route)
+
+	addr = [16]byte{0x20, 0x02}
+	_, err = r.SourceRouteForAddress(&addr)
+	assert.Equal(t, ErrUnknownDestination, err)
+
+	// No-Path removes only the prefix
+	assert.Nil(t, readPrefixDao(r, moteB, moteA, 2, long, 48, NO_PATH_LIFETIME))
+	assert.Equal(t, 0, len(r.PrefixRoutes(moteB)))
+	_, ok := r.findNode(moteB)
+	assert.True(t, ok)
+}
+
+func TestPrefixMatch(t *testing.T) {
+	prefix := [16]byte{0x20, 0x01, 0x0D, 0xB0}
+	addr := [16]byte{0x20, 0x01, 0x0D, 0xB8}
+	assert.True(t, matchPrefix(&addr, &prefix, 28))
+	assert.False(t, matchPrefix(&addr, &prefix, 29))
+	assert.True(t, matchPrefix(&addr, &prefix, 0))
+}
+
+func TestExpirePrefix(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	SetLifetimeUnit(60)
+	updateLink(r, rootId[:], moteA, 1, 0xFF)
+	prefix := [16]byte{0x20, 0x01, 0x0D, 0xB8}
+	assert.Nil(t, readPrefixDao(r, moteA, rootId[:], 2, prefix, 32, 10))
+	// link to root also has lifetime 10
+	updateLink(r, rootId[:], moteA, 3, 0xFF)
+
+	ExpireRoutes(time.Now().Add(11 * time.Minute))
+	assert.Equal(t, 0, len(r.PrefixRoutes(moteA)))
+	_, ok := r.findNode(moteA)
+	assert.True(t, ok)
+}
@@ -0,0 +1,409 @@
+package router
+
+/*
+Projected routes, RFC 9914. The router has a global view of the DODAG, so it
+acts as the path computation element. It computes a path through the mesh
+between two motes, the Track ingress and egress, and the root sends a Projected
+DAO (P-DAO) to the ingress to install the path as a Track. The Track is a Local
+RPL Instance, with the TrackID as its RPLInstanceID and the ingress address as
+its DODAGID.
+
+The path is installed as a non-storing mode Track. The P-DAO carries a Target
+for the egress and a Source-Routed Via Information option (SR-VIO) listing the
+hops after the ingress, so the ingress source routes packets along the Track.
+The P-DAO requests a DAO-ACK from the ingress, which confirms the Track is
+installed.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/kb2ma/daghead/internal/log"
+	"time"
+)
+
+const (
+	// Length of a VIO before the SRH-6LoRH, excluding type and length
+	RPL_VIO_LEN int = 4
+	// Hops after the ingress that fit in an SR-VIO, as full addresses, since the
+	// option length is one byte; fewer than the SRH-6LoRH Size field allows
+	TRACK_MAX_HOPS int = (0xFF - RPL_VIO_LEN - 2) / 16
+	// Local RPLInstanceIDs available for TrackIDs, RFC 6550 sec. 5.1
+	TRACK_ID_MIN byte = 0x80
+	TRACK_ID_MAX byte = 0xBF
+	// Time to wait for a DAO-ACK from the ingress before the Track fails
+	DEFAULT_PDAO_ACK_TIMEOUT = 30 * time.Second
+	// Time after the P-DAO is sent to release the TrackID for a rejected or failed Track
+	DEFAULT_TRACK_RELEASE_TIMEOUT = 5 * time.Minute
+)
+
+// Provides a common type for Track state constants
+type TrackState int
+
+// Track states
+const (
+	// P-DAO sent, waiting for a DAO-ACK
+	TRACK_PENDING TrackState = iota + 1
+	// DAO-ACK accepted the P-DAO
+	TRACK_INSTALLED
+	// DAO-ACK rejected the P-DAO
+	TRACK_REJECTED
+	// No DAO-ACK received
+	TRACK_FAILED
+)
+
+var (
+	ErrNoPath = errors.New("no path between motes")
+	ErrNoTrackId = errors.New("no TrackID available")
+	ErrUnknownTrack = errors.New("track not known")
+
+	pdaoAckTimeout = DEFAULT_PDAO_ACK_TIMEOUT
+	trackReleaseTimeout = DEFAULT_TRACK_RELEASE_TIMEOUT
+)
+
+// Projected route installed as a Track from the ingress to the egress
+type ProjectedRoute struct {
+	TrackId byte
+	// Path from the ingress to the egress
+	Path [][]byte
+	State TrackState
+	// DAOSequence of the last P-DAO for the Track
+	Sequence byte
+	// Segment Lifetime, in units of the router's lifetime unit
+	Lifetime byte
+	Sent time.Time
+	// zero if the Track does not expire
+	expires time.Time
+	// Set in a copy from r.Tracks(); installed and all links still in the routing table
+	Active bool
+}
+
+func (s TrackState) String() string {
+	switch s {
+	case TRACK_PENDING:
+		return "pending"
+	case TRACK_INSTALLED:
+		return "installed"
+	case TRACK_REJECTED:
+		return "rejected"
+	case TRACK_FAILED:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// Returns the ID of the Track ingress
+func (track *ProjectedRoute) IngressId() []byte {
+	return track.Path[0]
+}
+
+// Returns the ID of the Track egress
+func (track *ProjectedRoute) EgressId() []byte {
+	return track.Path[len(track.Path)-1]
+}
+
+/*
+Computes the shortest path from the ingress to the egress, by hop count, over
+the links in the routing table. A link may be used in either direction, since
+it is a radio link between neighbors. Avoids suspect links, the root, and the
+nodes in avoid. Returns the path from the ingress through the egress, or
+ErrPathTooLong if the path has more hops than fit in a P-DAO. The routing table
+must be locked.
+*/
+func (r *Router) computePath(ingressId []byte, egressId []byte, avoid [][]byte) ([][]byte, error) {
+	ingress, ok := r.findNode(ingressId)
+	if !ok || (ingress == r.rootNode) {
+		return nil, ErrUnknownDestination
+	}
+	egress, ok := r.findNode(egressId)
+	if !ok || (egress == r.rootNode) || (egress == ingress) {
+		return nil, ErrUnknownDestination
+	}
+
+	// previous node on the path from the ingress, for each node reached
+	previous := map[*RplNode]*RplNode{ingress: nil}
+	previous[r.rootNode] = nil
+	for _, id := range avoid {
+		if node, ok := r.findNode(id); ok && (node != ingress) && (node != egress) {
+			previous[node] = nil
+		}
+	}
+	queue := []*RplNode{ingress}
+	for len(queue) > 0 && (previous[egress] == nil) {
+		n := queue[0]
+		queue = queue[1:]
+		for _, neighbor := range n.neighbors() {
+			if _, seen := previous[neighbor]; !seen {
+				previous[neighbor] = n
+				queue = append(queue, neighbor)
+			}
+		}
+	}
+	if previous[egress] == nil {
+		return nil, ErrNoPath
+	}
+
+	var path [][]byte
+	for n := egress; n != nil; n = previous[n] {
+		path = append([][]byte{n.Id}, path...)
+	}
+	if (len(path) - 1 > maxPathLength) || (len(path) - 1 > TRACK_MAX_HOPS) {
+		return nil, ErrPathTooLong
+	}
+	return path, nil
+}
+
+// Returns the nodes linked to node by a link that is not suspect, parents first
+func (node *RplNode) neighbors() []*RplNode {
+	neighbors := make([]*RplNode, 0, len(node.parents) + len(node.children))
+	for _, link := range node.parents {
+		if !link.Suspect {
+			neighbors = append(neighbors, link.Parent)
+		}
+	}
+	for _, child := range node.children {
+		if link := child.findLink(node); (link != nil) && !link.Suspect {
+			neighbors = append(neighbors, child)
+		}
+	}
+	return neighbors
+}
+
+/*
+Computes a path from the ingress to the egress, and records a Track for it,
+pending a DAO-ACK for the P-DAO. If disjoint, the path avoids the intermediate
+nodes of the other Tracks between the same ingress and egress, for a redundant
+path. Returns a copy of the Track, to encode in a P-DAO.
+*/
+func (r *Router) ProjectRoute(ingressId []byte, egressId []byte, disjoint bool,
+                              lifetime byte) (*ProjectedRoute, error) {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	var avoid [][]byte
+	if disjoint {
+		for _, track := range r.tracks {
+			if bytes.Equal(track.IngressId(), ingressId) &&
+			   bytes.Equal(track.EgressId(), egressId) {
+				avoid = append(avoid, track.Path[1:len(track.Path)-1]...)
+			}
+		}
+	}
+	path, err := r.computePath(ingressId, egressId, avoid)
+	if err != nil {
+		return nil, err
+	}
+	trackId, ok := r.nextTrackId()
+	if !ok {
+		return nil, ErrNoTrackId
+	}
+
+	track := &ProjectedRoute{TrackId: trackId, Path: path, State: TRACK_PENDING,
+	                         Sequence: r.nextPdaoSequence(), Lifetime: lifetime,
+	                         Sent: time.Now(), expires: expiryTime(lifetime, r.lifetimeUnit)}
+	r.tracks = append(r.tracks, track)
+	log.Printf(log.INFO, "Projected Track %d from [% X] to [% X], %d hops\n", trackId,
+	           ingressId, egressId, len(path) - 1)
+	return track.copy(), nil
+}
+
+/*
+Removes the Track, and returns a copy with a No-Path lifetime and a new
+sequence, to encode in a P-DAO that removes the Track from the ingress.
+*/
+func (r *Router) RemoveTrack(trackId byte) (*ProjectedRoute, error) {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	for i, track := range r.tracks {
+		if track.TrackId == trackId {
+			r.tracks = append(r.tracks[:i], r.tracks[i+1:]...)
+			removed := track.copy()
+			removed.Lifetime = NO_PATH_LIFETIME
+			removed.Sequence = r.nextPdaoSequence()
+			log.Printf(log.INFO, "Removed Track %d\n", trackId)
+			return removed, nil
+		}
+	}
+	return nil, ErrUnknownTrack
+}
+
+// Returns copies of the Tracks, in the order created
+func (r *Router) Tracks() []ProjectedRoute {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	return r.copyTracks()
+}
+
+func (r *Router) copyTracks() []ProjectedRoute {
+	tracks := make([]ProjectedRoute, len(r.tracks))
+	for i, track := range r.tracks {
+		tracks[i] = *track.copy()
+		tracks[i].Active = (track.State == TRACK_INSTALLED) && r.hasPath(track.Path)
+	}
+	return tracks
+}
+
+// Returns true if each pair of nodes along path is linked in the routing table
+func (r *Router) hasPath(path [][]byte) bool {
+	for i := 1; i < len(path); i++ {
+		a, okA := r.findNode(path[i-1])
+		b, okB := r.findNode(path[i])
+		if !okA || !okB || ((a.findLink(b) == nil) && (b.findLink(a) == nil)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the Track for trackId, or nil if not found
+func (r *Router) findTrack(trackId byte) *ProjectedRoute {
+	for _, track := range r.tracks {
+		if track.TrackId == trackId {
+			return track
+		}
+	}
+	return nil
+}
+
+// Returns the lowest TrackID not in use
+func (r *Router) nextTrackId() (byte, bool) {
+	for id := int(TRACK_ID_MIN); id <= int(TRACK_ID_MAX); id++ {
+		if r.findTrack(byte(id)) == nil {
+			return byte(id), true
+		}
+	}
+	return 0, false
+}
+
+// Returns the DAOSequence for the next P-DAO from the root
+func (r *Router) nextPdaoSequence() byte {
+	seq := r.pdaoSequence
+	r.pdaoSequence = IncrementSequence(seq)
+	return seq
+}
+
+func (track *ProjectedRoute) copy() *ProjectedRoute {
+	copied := *track
+	copied.Path = make([][]byte, len(track.Path))
+	for i, id := range track.Path {
+		copied.Path[i] = copyId(id)
+	}
+	return &copied
+}
+
+/*
+Updates the state of a Track in any router from a DAO-ACK for its P-DAO, from
+the mote at source. Returns false if the DAO-ACK is not for a Track. The
+routers must be locked.
+*/
+func ackTracks(sourceId []byte, ack *RplDaoAck) bool {
+	for _, r := range routers {
+		if r.ackTrack(sourceId, ack) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Updates the state of a Track from a DAO-ACK for its P-DAO, from the mote at
+source. The RPLInstanceID of the DAO-ACK is the TrackID. Returns false if the
+DAO-ACK is not for a Track of this router. The routing table must be locked.
+*/
+func (r *Router) ackTrack(sourceId []byte, ack *RplDaoAck) bool {
+	for _, track := range r.tracks {
+		if (track.TrackId != ack.InstanceId) || (track.Sequence != ack.Sequence) ||
+		   !bytes.Equal(track.IngressId(), sourceId) {
+			continue
+		}
+		if ack.Status < DAO_ACK_REJECT {
+			track.State = TRACK_INSTALLED
+			log.Printf(log.INFO, "Track %d installed at [% X]\n", track.TrackId, sourceId)
+		} else {
+			track.State = TRACK_REJECTED
+			log.Printf(log.WARN, "Track %d rejected by [% X], status 0x%X\n", track.TrackId,
+			           sourceId, ack.Status)
+		}
+		return true
+	}
+	return false
+}
+
+/*
+Removes Tracks with a Segment Lifetime that has expired as of now, and releases
+the TrackIDs for rejected and failed Tracks after trackReleaseTimeout. Marks
+Tracks still pending as failed if the DAO-ACK has timed out.
+*/
+func (r *Router) expireTracks(now time.Time) {
+	tracks := r.tracks[:0]
+	for _, track := range r.tracks {
+		if !track.expires.IsZero() && !now.Before(track.expires) {
+			log.Printf(log.INFO, "Track %d expired\n", track.TrackId)
+			continue
+		}
+		if ((track.State == TRACK_REJECTED) || (track.State == TRACK_FAILED)) &&
+		   !now.Before(track.Sent.Add(trackReleaseTimeout)) {
+			log.Printf(log.INFO, "Track %d released; %v\n", track.TrackId, track.State)
+			continue
+		}
+		tracks = append(tracks, track)
+		if (track.State == TRACK_PENDING) && !now.Before(track.Sent.Add(pdaoAckTimeout)) {
+			track.State = TRACK_FAILED
+			log.Printf(log.WARN, "Track %d failed; no DAO-ACK from [% X]\n", track.TrackId,
+			           track.IngressId())
+		}
+	}
+	r.tracks = tracks
+}
+
+/*
+Returns an ICMPv6 P-DAO message for the Track, with checksum not yet set. The
+DAO base object includes the ingress address as DODAGID, followed by a Target
+option for the egress and an SR-VIO.
+*/
+func EncodePdao(track *ProjectedRoute) []byte {
+	msg := []byte{ICMPv6_TYPE_RPL, RPL_CODE_DAO, 0, 0,
+	              track.TrackId, RPL_DAO_K_FLAG | RPL_DAO_D_FLAG | RPL_DAO_P_FLAG, 0,
+	              track.Sequence}
+	ingress := NodeAddress(track.IngressId())
+	msg = append(msg, ingress[:]...)
+
+	egress := NodeAddress(track.EgressId())
+	msg = append(msg, RPL_TYPE_TARGET_INFORMATION, byte(2 + len(egress)), 0, 128)
+	msg = append(msg, egress[:]...)
+	return append(msg, encodeSrVio(track)...)
+}
+
+/*
+Encodes the SR-VIO for the Track. The Via Addresses are the hops after the
+ingress, through the egress, uncompressed in a single SRH-6LoRH.
+
+  0                   1                   2                   3
+  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ |   Type        | Option Length |     Flags     |   Segment ID  |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ |Segment Sequence| Seg. Lifetime|      SRH-6LoRH header         |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ |                    Via Address 1 ... n                        |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+*/
+func encodeSrVio(track *ProjectedRoute) []byte {
+	hops := track.Path[1:]
+	length := RPL_VIO_LEN + 2 + (len(hops) * 16)
+	vio := make([]byte, 0, 2 + length)
+	// Segment ID 0, since the Track has a single segment
+	vio = append(vio, RPL_TYPE_SR_VIO, byte(length), 0, 0, track.Sequence, track.Lifetime,
+	             CRITICAL_6LoRH | byte(len(hops) - 1), TYPE_6LoRH_SRH_MAX)
+	for _, id := range hops {
+		addr := NodeAddress(id)
+		vio = append(vio, addr[:]...)
+	}
+	return vio
+}
+
+// Returns a description of the Track, for logging
+func (track *ProjectedRoute) String() string {
+	return fmt.Sprintf("Track %d %s, path % X", track.TrackId, track.State, track.Path)
+}
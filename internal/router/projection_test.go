@@ -0,0 +1,210 @@
+package router
+
+import (
+  "bytes"
+  "testing"
+  "time"
+  "github.com/stretchr/testify/assert"
+)
+
+var moteE = []byte{0x82, 0x54, 0x7D, 0x13, 0x76, 0x65, 0x79, 0x7C}
+
+/*
+Creates a routing table with two paths from A to D, through B and through E,
+plus C below the root.
+
+  root -> A -> B -> D
+       |    -> E ---^
+       -> C
+*/
+func initProjection(t *testing.T) *Router {
+	resetRouters(t)
+	return initProjectionLinks(InitRootNode(rootId))
+}
+
+// Adds the links for initProjection() to r
+func initProjectionLinks(r *Router) *Router {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	updateLink(r, rootId[:], moteA, 1, 0xFF)
+	updateLink(r, rootId[:], moteC, 1, 0xFF)
+	updateLink(r, moteA, moteB, 1, 0xFF)
+	updateLink(r, moteA, moteE, 1, 0xFF)
+	r.updateLinks(moteD, []linkUpdate{{parentId: moteB, pathSequence: 1, lifetime: 0xFF},
+	                                  {parentId: moteE, pathSequence: 1, lifetime: 0xFF}})
+	return r
+}
+
+// Tests path computation, including a disjoint path, and removal of a Track
+func TestProjectRoute(t *testing.T) {
+	r := initProjection(t)
+	track, err := r.ProjectRoute(moteA, moteD, false, INFINITE_LIFETIME)
+	assert.Nil(t, err)
+	assert.Equal(t, TRACK_ID_MIN, track.TrackId)
+	assert.Equal(t, [][]byte{moteA, moteB, moteD}, track.Path)
+	assert.Equal(t, TRACK_PENDING, track.State)
+
+	track, err = r.ProjectRoute(moteA, moteD, true, INFINITE_LIFETIME)
+	assert.Nil(t, err)
+	assert.Equal(t, TRACK_ID_MIN + 1, track.TrackId)
+	assert.Equal(t, [][]byte{moteA, moteE, moteD}, track.Path)
+	// no third disjoint path
+	_, err = r.ProjectRoute(moteA, moteD, true, INFINITE_LIFETIME)
+	assert.Equal(t, ErrNoPath, err)
+
+	// upward over a link, but not through the root
+	track, err = r.ProjectRoute(moteD, moteA, false, INFINITE_LIFETIME)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{moteD, moteB, moteA}, track.Path)
+	_, err = r.ProjectRoute(moteA, moteC, false, INFINITE_LIFETIME)
+	assert.Equal(t, ErrNoPath, err)
+	_, err = r.ProjectRoute(moteA, rootId[:], false, INFINITE_LIFETIME)
+	assert.Equal(t, ErrUnknownDestination, err)
+
+	removed, err := r.RemoveTrack(TRACK_ID_MIN)
+	assert.Nil(t, err)
+	assert.Equal(t, NO_PATH_LIFETIME, removed.Lifetime)
+	assert.Equal(t, 2, len(r.Tracks()))
+	_, err = r.RemoveTrack(TRACK_ID_MIN)
+	assert.Equal(t, ErrUnknownTrack, err)
+	// lowest TrackID reused
+	track, _ = r.ProjectRoute(moteA, moteD, false, INFINITE_LIFETIME)
+	assert.Equal(t, TRACK_ID_MIN, track.TrackId)
+}
+
+// Tests Track state from a DAO-ACK, and whether the Track is active
+func TestTrackState(t *testing.T) {
+	r := initProjection(t)
+	track, _ := r.ProjectRoute(moteA, moteD, false, 10)
+	other, _ := r.ProjectRoute(moteA, moteD, true, INFINITE_LIFETIME)
+
+	ip := &IpData{Fields: make(map[string]int)}
+	copy(ip.Source[8:], moteA)
+	ack := []byte{track.TrackId, 0, track.Sequence, DAO_ACK_ACCEPT}
+	assert.Nil(t, ReadRpl(ip, RPL_CODE_DAO_ACK, ack))
+	tracks := r.Tracks()
+	assert.Equal(t, TRACK_INSTALLED, tracks[0].State)
+	assert.True(t, tracks[0].Active)
+	assert.Equal(t, TRACK_PENDING, tracks[1].State)
+
+	// inactive when a link along the path is gone
+	tableLock.Lock()
+	updateLink(r, moteE, moteD, 2, 0xFF)
+	tableLock.Unlock()
+	assert.False(t, r.Tracks()[0].Active)
+
+	ack = []byte{other.TrackId, 0, other.Sequence, DAO_ACK_REJECT}
+	assert.Nil(t, ReadRpl(ip, RPL_CODE_DAO_ACK, ack))
+	assert.Equal(t, TRACK_REJECTED, r.Snapshot().Tracks[1].State)
+
+	// ack timeout, then rejected and failed Tracks released, then lifetime expiry
+	third, _ := r.ProjectRoute(moteD, moteA, false, INFINITE_LIFETIME)
+	ExpireRoutes(time.Now().Add(DEFAULT_PDAO_ACK_TIMEOUT))
+	tracks = r.Tracks()
+	assert.Equal(t, 3, len(tracks))
+	assert.Equal(t, TRACK_FAILED, tracks[2].State)
+	ExpireRoutes(time.Now().Add(DEFAULT_TRACK_RELEASE_TIMEOUT))
+	tracks = r.Tracks()
+	assert.Equal(t, 1, len(tracks))
+	assert.Equal(t, track.TrackId, tracks[0].TrackId)
+	// TrackID reused
+	reused, _ := r.ProjectRoute(moteD, moteA, false, INFINITE_LIFETIME)
+	assert.Equal(t, other.TrackId, reused.TrackId)
+	assert.NotEqual(t, third.TrackId, reused.TrackId)
+	ExpireRoutes(time.Now().Add(time.Duration(10 * DEFAULT_LIFETIME_UNIT) * time.Second))
+	tracks = r.Tracks()
+	assert.Equal(t, 1, len(tracks))
+	assert.Equal(t, reused.TrackId, tracks[0].TrackId)
+}
+
+// Tests encoding a P-DAO, read back as a DAO
+func TestEncodePdao(t *testing.T) {
+	track := &ProjectedRoute{TrackId: TRACK_ID_MIN, Path: [][]byte{moteA, moteB, moteD},
+	                         Sequence: 5, Lifetime: 0x20}
+	msg := EncodePdao(track)
+	assert.Equal(t, RPL_CODE_DAO, msg[1])
+	dao, i, err := ReadDao(msg[ICMPv6_HEADER_LEN:])
+	assert.Nil(t, err)
+	assert.Equal(t, TRACK_ID_MIN, dao.InstanceId)
+	assert.True(t, dao.WantsAck)
+	assert.Equal(t, NodeAddress(moteA), dao.DodagId)
+	assert.NotEqual(t, byte(0), msg[ICMPv6_HEADER_LEN + 1] & RPL_DAO_P_FLAG)
+
+	opts, err := ReadRplOptions(msg[ICMPv6_HEADER_LEN+i:])
+	assert.Nil(t, err)
+	assert.Equal(t, NodeAddress(moteD), opts.DaoGroups[0].Targets[0].Prefix)
+
+	vio := msg[len(msg) - (2 + RPL_VIO_LEN + 2 + 32):]
+	assert.Equal(t, RPL_TYPE_SR_VIO, vio[0])
+	assert.Equal(t, byte(RPL_VIO_LEN + 2 + 32), vio[1])
+	assert.Equal(t, []byte{5, 0x20, CRITICAL_6LoRH | 1, TYPE_6LoRH_SRH_MAX}, vio[4:8])
+	addr := NodeAddress(moteB)
+	assert.Equal(t, addr[:], vio[8:24])
+	addr = NodeAddress(moteD)
+	assert.Equal(t, addr[:], vio[24:])
+}
+
+// Tests that a global repair keeps the Tracks, inactive until their links return
+func TestTrackGlobalRepair(t *testing.T) {
+	r := initProjection(t)
+	track, _ := r.ProjectRoute(moteA, moteD, false, INFINITE_LIFETIME)
+	ip := &IpData{Fields: make(map[string]int)}
+	copy(ip.Source[8:], moteA)
+	ack := []byte{track.TrackId, 0, track.Sequence, DAO_ACK_ACCEPT}
+	assert.Nil(t, ReadRpl(ip, RPL_CODE_DAO_ACK, ack))
+	assert.True(t, r.Tracks()[0].Active)
+
+	r.GlobalRepair(r.NextVersion())
+	tracks := r.Tracks()
+	assert.Equal(t, 1, len(tracks))
+	assert.False(t, tracks[0].Active)
+	// TrackID not reused
+	other, _ := initProjectionLinks(r).ProjectRoute(moteA, moteD, true, INFINITE_LIFETIME)
+	assert.NotEqual(t, track.TrackId, other.TrackId)
+	assert.True(t, r.Tracks()[0].Active)
+}
+
+// Tests saving and restoring the Tracks
+func TestRestoreTracks(t *testing.T) {
+	r := initProjection(t)
+	track, _ := r.ProjectRoute(moteA, moteD, false, INFINITE_LIFETIME)
+	var saved bytes.Buffer
+	assert.Nil(t, SaveTables(&saved))
+
+	routers = nil
+	rootMoteId = nil
+	assert.Nil(t, RestoreTables(bytes.NewReader(saved.Bytes())))
+	r = InitRootNode(rootId)
+	tracks := r.Tracks()
+	assert.Equal(t, 1, len(tracks))
+	assert.Equal(t, track.TrackId, tracks[0].TrackId)
+	assert.Equal(t, track.Path, tracks[0].Path)
+	assert.Equal(t, TRACK_PENDING, tracks[0].State)
+	next, _ := r.ProjectRoute(moteA, moteD, true, INFINITE_LIFETIME)
+	assert.Equal(t, track.Sequence + 1, next.Sequence)
+}
+
+// Tests that a path with more hops than fit in an SR-VIO is rejected
+func TestProjectRouteTooLong(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	SetMaxPathLength(2 * TRACK_MAX_HOPS)
+	tableLock.Lock()
+	parentId := rootId[:]
+	var chain [][]byte
+	for i := 0; i <= TRACK_MAX_HOPS + 1; i++ {
+		id := []byte{0x02, 0x12, 0x4B, 0x00, 0, 0, 0, byte(i)}
+		updateLink(r, parentId, id, 1, 0xFF)
+		chain = append(chain, id)
+		parentId = id
+	}
+	tableLock.Unlock()
+
+	track, err := r.ProjectRoute(chain[0], chain[TRACK_MAX_HOPS], false, INFINITE_LIFETIME)
+	assert.Nil(t, err)
+	vio := EncodePdao(track)
+	vio = vio[len(vio) - (2 + RPL_VIO_LEN + 2 + TRACK_MAX_HOPS * 16):]
+	assert.Equal(t, byte(RPL_VIO_LEN + 2 + TRACK_MAX_HOPS * 16), vio[1])
+	_, err = r.ProjectRoute(chain[0], chain[TRACK_MAX_HOPS + 1], false, INFINITE_LIFETIME)
+	assert.Equal(t, ErrPathTooLong, err)
+}
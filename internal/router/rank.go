@@ -0,0 +1,146 @@
+package router
+
+/*
+Rank of each mote, as advertised in its DIOs and in the RPI SenderRank of the
+packets it forwards to the root. Rank is compared with the routing table built
+from DAOs to find inconsistencies, like a child with a rank no greater than its
+parent's. Ranks are compared as DAGRank, in units of MinHopRankIncrease from
+the DIO DODAG Configuration option, as for RFC 6550 sec. 3.5.1.
+*/
+
+import (
+	"github.com/kb2ma/daghead/internal/log"
+	"time"
+)
+
+const (
+	// RFC 6550 sec. 17
+	DEFAULT_MIN_HOP_RANK_INCREASE int = 256
+	// Rank value when not known
+	NO_RANK int = -1
+)
+
+// Provides a common type for rank inconsistency flags
+type RankFlags byte
+
+// Rank inconsistencies for a node, as bit flags
+const (
+	// DAGRank not greater than the DAGRank of a parent in the routing table
+	RANK_NOT_BELOW_PARENT RankFlags = 1 << iota
+	// DAGRank less than the hop depth of the node's route from the root allows,
+	// since each hop increases rank by at least MinHopRankIncrease
+	RANK_LESS_THAN_DEPTH
+)
+
+// Sets MinHopRankIncrease for this router, as learned from a DIO
+func (r *Router) SetMinHopRankIncrease(increase int) {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	r.setMinHopRankIncrease(increase)
+}
+
+func (r *Router) setMinHopRankIncrease(increase int) {
+	if (increase != r.minHopRankIncrease) && (increase > 0) {
+		r.minHopRankIncrease = increase
+		log.Printf(log.INFO, "Set MinHopRankIncrease to %d for instance %d\n", increase,
+		           r.key.InstanceId)
+	}
+}
+
+/*
+Updates the rank for the node for id, from a DIO or from the SenderRank in the
+RPI of a packet forwarded by the node. Ignores a node not in the routing table.
+Emits an EVENT_RANK_INCONSISTENT for the node, or for a child of the node, when
+the update finds a new inconsistency. The routing table must not be locked.
+*/
+func (r *Router) UpdateRank(id []byte, rank int) {
+	tableLock.Lock()
+	r.updateRank(id, rank)
+	events := takeEvents()
+	tableLock.Unlock()
+
+	emitEvents(events)
+}
+
+// Updates the rank for the node for id; the routing table must be locked
+func (r *Router) updateRank(id []byte, rank int) {
+	node, ok := r.findNode(id)
+	if !ok || (node == r.rootNode) {
+		log.Printf(log.DEBUG, "Ignoring rank %d for [% X]\n", rank, id)
+		return
+	}
+	node.rankUpdated = time.Now()
+	if rank == node.rank {
+		return
+	}
+	log.Printf(log.DEBUG, "Update rank for [% X] from %d to %d\n", id, node.rank, rank)
+	node.rank = rank
+	r.checkRank(node)
+	for _, child := range node.children {
+		r.checkRank(child)
+	}
+}
+
+// Updates the rank inconsistency flags for node, and queues an event if a flag is new
+func (r *Router) checkRank(node *RplNode) {
+	flags := r.rankFlags(node)
+	added := flags &^ node.rankFlags
+	node.rankFlags = flags
+	if added == 0 {
+		return
+	}
+	log.Printf(log.WARN, "Rank %d for [% X] inconsistent, flags 0x%X\n", node.rank, node.Id,
+	           flags)
+	event := Event{Type: EVENT_RANK_INCONSISTENT, NodeId: node.Id}
+	if parent := node.preferredParent(); parent != nil {
+		event.ParentId = parent.Id
+	}
+	r.queueEvent(event)
+}
+
+/*
+Returns the rank inconsistencies for node, compared with the rank of each
+parent and with the hop depth of its route. A parent with an unknown rank is
+not compared.
+*/
+func (r *Router) rankFlags(node *RplNode) RankFlags {
+	var flags RankFlags
+	if (node.rank == NO_RANK) || (node == r.rootNode) {
+		return flags
+	}
+	for _, link := range node.parents {
+		parentRank := r.rankOf(link.Parent)
+		if (parentRank != NO_RANK) && (r.dagRank(node.rank) <= r.dagRank(parentRank)) {
+			flags |= RANK_NOT_BELOW_PARENT
+		}
+	}
+	if depth := r.hopDepth(node); depth > 0 {
+		if r.dagRank(node.rank) < r.dagRank(r.rankOf(r.rootNode)) + depth {
+			flags |= RANK_LESS_THAN_DEPTH
+		}
+	}
+	return flags
+}
+
+// Returns the rank of node; the root's rank is MinHopRankIncrease
+func (r *Router) rankOf(node *RplNode) int {
+	if node == r.rootNode {
+		return r.minHopRankIncrease
+	}
+	return node.rank
+}
+
+// RFC 6550 sec. 3.5.1
+func (r *Router) dagRank(rank int) int {
+	return rank / r.minHopRankIncrease
+}
+
+// Returns the count of hops in the selected route from the root to node, or -1 if
+// not reachable
+func (r *Router) hopDepth(node *RplNode) int {
+	route, ok := r.selectRoute(node.Id)
+	if !ok {
+		return -1
+	}
+	return len(route) - 1
+}
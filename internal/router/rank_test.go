@@ -0,0 +1,75 @@
+package router
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+// Tests rank inconsistencies with a parent and with hop depth
+func TestRankInconsistency(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	var events []Event
+	SetEventHandler(func(event Event) {
+		events = append(events, event)
+	})
+
+	updateLink(r, rootId[:], moteA, 1, 0xFF)
+	updateLink(r, moteA, moteB, 1, 0xFF)
+	takeEvents()
+
+	r.UpdateRank(moteA, 768)
+	r.UpdateRank(moteB, 1024)
+	assert.Equal(t, 0, len(events))
+	snap := r.Snapshot()
+	assert.Equal(t, 256, snap.Node(rootId[:]).Rank)
+	assert.Equal(t, 2, snap.Node(moteB).HopDepth)
+	assert.Equal(t, RankFlags(0), snap.Node(moteB).RankFlags)
+
+	// same DAGRank as parent
+	r.UpdateRank(moteB, 0x3FF)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, EVENT_RANK_INCONSISTENT, events[0].Type)
+	assert.Equal(t, moteB, events[0].NodeId)
+	assert.Equal(t, moteA, events[0].ParentId)
+	assert.Equal(t, RANK_NOT_BELOW_PARENT, r.Snapshot().Node(moteB).RankFlags)
+
+	// not repeated while unchanged
+	r.UpdateRank(moteB, 0x380)
+	assert.Equal(t, 1, len(events))
+
+	// A at the root's rank; B now is below A
+	r.UpdateRank(moteA, 256)
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, moteA, events[1].NodeId)
+	snap = r.Snapshot()
+	assert.Equal(t, RANK_NOT_BELOW_PARENT | RANK_LESS_THAN_DEPTH, snap.Node(moteA).RankFlags)
+	assert.Equal(t, RankFlags(0), snap.Node(moteB).RankFlags)
+
+	// unknown mote ignored
+	r.UpdateRank(moteC, 512)
+	assert.Nil(t, r.Snapshot().Node(moteC))
+}
+
+// Tests a DIO sets MinHopRankIncrease and the rank of the sender
+func TestDioRank(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	updateLink(r, rootId[:], moteA, 1, 0xFF)
+	takeEvents()
+
+	dio := append([]byte{}, dioData...)
+	// rank 1536
+	dio[2] = 0x06
+	config := []byte{0x04, 0x0E, 0x00, 0x08, 0x0C, 0x0A, 0x07, 0x00,
+	                 0x02, 0x00, 0x00, 0x01, 0x00, 0xFF, 0x00, 0x3C}
+	ip := &IpData{Fields: make(map[string]int)}
+	copy(ip.Source[8:], moteA)
+	assert.Nil(t, ReadRpl(ip, RPL_CODE_DIO, append(dio, config...)))
+
+	snap := r.Snapshot()
+	assert.Equal(t, 512, snap.MinHopRankIncrease)
+	assert.Equal(t, 1536, snap.Node(moteA).Rank)
+	assert.False(t, snap.Node(moteA).RankUpdated.IsZero())
+	assert.Equal(t, RankFlags(0), snap.Node(moteA).RankFlags)
+}
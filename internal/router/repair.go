@@ -0,0 +1,98 @@
+package router
+
+/*
+Global repair of a DODAG, RFC 6550 sec. 3.2.2. The root increments the DODAG
+Version Number in its DIOs, and each mote rejoins the new version of the DODAG
+and sends a new DAO. The routing table from the old version may include stale
+links and loops, so it is reset, and the DAOs for the new version rebuild it.
+
+A repair is requested from the root mote, which must be told the new version.
+The router learns the current version from DIOs. A repair started elsewhere is
+found from a DIO with a greater version.
+*/
+
+import (
+	"bytes"
+	"github.com/kb2ma/daghead/internal/log"
+	"sort"
+)
+
+// Version Number of a new DODAG in OpenWSN firmware, assumed until read from a DIO
+const DEFAULT_DODAG_VERSION byte = 0
+
+// Returns the current DODAG Version Number, or NO_SEQUENCE if not known
+func (r *Router) Version() int {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	return r.version
+}
+
+// Returns the version for a global repair, which follows the current version
+func (r *Router) NextVersion() byte {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	if r.version == NO_SEQUENCE {
+		return IncrementSequence(DEFAULT_DODAG_VERSION)
+	}
+	return IncrementSequence(byte(r.version))
+}
+
+/*
+Starts a global repair for the new version, after the root mote has been told
+to use it. Resets the routing table and emits an EVENT_GLOBAL_REPAIR. The
+routing table must not be locked.
+*/
+func (r *Router) GlobalRepair(version byte) {
+	tableLock.Lock()
+	r.startVersion(version)
+	events := takeEvents()
+	tableLock.Unlock()
+
+	emitEvents(events)
+}
+
+/*
+Updates the version from a DIO. Starts a global repair if the version is
+greater than the current version, so a repair not started here still resets
+the routing table.
+*/
+func (r *Router) updateVersion(version byte) {
+	if r.version == NO_SEQUENCE {
+		r.version = int(version)
+		log.Printf(log.INFO, "DODAG version %d for instance %d\n", version, r.key.InstanceId)
+		return
+	}
+	switch CompareSequence(version, byte(r.version)) {
+	case SEQ_GREATER:
+		r.startVersion(version)
+	case SEQ_LESS, SEQ_NOT_COMPARABLE:
+		log.Printf(log.DEBUG, "Ignoring DODAG version %d for instance %d; current %d\n",
+		           version, r.key.InstanceId, r.version)
+	}
+}
+
+/*
+Sets the version and resets the routing table to only the root node. Pending
+links also are from the old version, so are dropped. Queues an
+EVENT_GLOBAL_REPAIR with the IDs of the nodes removed.
+*/
+func (r *Router) startVersion(version byte) {
+	r.version = int(version)
+	log.Printf(log.INFO, "Global repair for instance %d, version %d\n", r.key.InstanceId,
+	           version)
+	r.pendingLinks = nil
+	if r.rootNode == nil {
+		return
+	}
+	removed := make([][]byte, 0, len(r.nodes) - 1)
+	for _, node := range r.nodes {
+		if node != r.rootNode {
+			removed = append(removed, node.Id)
+		}
+	}
+	sort.Slice(removed, func(i, j int) bool {
+		return bytes.Compare(removed[i], removed[j]) < 0
+	})
+	r.setRoot()
+	r.queueEvent(Event{Type: EVENT_GLOBAL_REPAIR, NodeId: r.rootNode.Id, Removed: removed})
+}
@@ -0,0 +1,66 @@
+package router
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+// Tests a global repair resets the routing table, which then is rebuilt
+func TestGlobalRepair(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	var events []Event
+	SetEventHandler(func(event Event) {
+		events = append(events, event)
+	})
+
+	updateLink(r, rootId[:], moteB, 1, 0xFF)
+	updateLink(r, moteB, moteA, 1, 0xFF)
+	r.updateLinks(moteD, []linkUpdate{{parentId: moteC, pathSequence: 1, lifetime: 0xFF}})
+	takeEvents()
+	assert.Equal(t, NO_SEQUENCE, r.Version())
+	assert.Equal(t, byte(1), r.NextVersion())
+
+	r.GlobalRepair(r.NextVersion())
+	assert.Equal(t, 1, r.Version())
+	assert.Equal(t, 1, len(r.nodes))
+	assert.Equal(t, 0, len(r.rootNode.children))
+	assert.Equal(t, 0, len(r.PendingLinks()))
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, EVENT_GLOBAL_REPAIR, events[0].Type)
+	assert.Equal(t, rootId[:], events[0].NodeId)
+	assert.Equal(t, [][]byte{moteA, moteB}, events[0].Removed)
+
+	// DAOs for the new version
+	updateLink(r, rootId[:], moteA, 2, 0xFF)
+	route, err := r.SourceRoute(moteA)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{rootId[:], moteA}, route)
+	assert.Equal(t, byte(2), r.NextVersion())
+}
+
+// Tests the version from DIOs, and a repair found from a greater version
+func TestDioVersion(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	updateLink(r, rootId[:], moteA, 1, 0xFF)
+	takeEvents()
+
+	ip := &IpData{Fields: make(map[string]int)}
+	copy(ip.Source[8:], moteA)
+	dio := append([]byte{}, dioData...)
+	assert.Nil(t, ReadRpl(ip, RPL_CODE_DIO, dio))
+	assert.Equal(t, 2, r.Version())
+	assert.Equal(t, 2, len(r.nodes))
+
+	// older version ignored
+	dio[1] = 1
+	assert.Nil(t, ReadRpl(ip, RPL_CODE_DIO, dio))
+	assert.Equal(t, 2, r.Version())
+	assert.Equal(t, 2, len(r.nodes))
+
+	dio[1] = 3
+	assert.Nil(t, ReadRpl(ip, RPL_CODE_DIO, dio))
+	assert.Equal(t, 3, r.Version())
+	assert.Equal(t, 1, len(r.nodes))
+}
@@ -0,0 +1,85 @@
+package router
+
+// Source routes from the root into the mesh, computed from the routing table.
+
+import (
+	"errors"
+	"github.com/kb2ma/daghead/internal/log"
+)
+
+// Default maximum number of hops in a source route, excluding the root
+const DEFAULT_MAX_PATH_LENGTH = 16
+
+var (
+	ErrNoRoot = errors.New("root node not known")
+	ErrUnknownDestination = errors.New("destination not in routing table")
+	ErrUnreachable = errors.New("destination not reachable from root")
+	ErrPathTooLong = errors.New("path to destination too long")
+
+	maxPathLength = DEFAULT_MAX_PATH_LENGTH
+)
+
+// Sets the maximum number of hops in a source route, excluding the root
+func SetMaxPathLength(hops int) {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	maxPathLength = hops
+	for _, r := range routers {
+		r.invalidateRoutes()
+	}
+}
+
+/*
+Returns the source route to the node for id, as the list of node IDs starting
+with the root and ending with the node. Returns an error if the node is not
+known or not reachable, or if the route is longer than the maximum path length.
+
+In storing mode, a node not in the DAG may be reached through the next-hop
+table. Then the route is only the root and the next hop, since the motes route
+the packet down from their own tables.
+
+The route is shared with a cache, so the caller must not modify it.
+*/
+func (r *Router) SourceRoute(id []byte) ([][]byte, error) {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	return r.sourceRoute(id)
+}
+
+// Returns the source route to the node for id; the routing table must be locked
+func (r *Router) sourceRoute(id []byte) ([][]byte, error) {
+	if r.rootNode == nil {
+		return nil, ErrNoRoot
+	}
+	if route, ok := r.routeCache[toEui64(id)]; ok {
+		return route, nil
+	}
+	if _, ok := r.findNode(id); !ok {
+		addr := NodeAddress(id)
+		if route, ok := r.nextHopRoute(&addr); ok {
+			return route, nil
+		}
+		return nil, ErrUnknownDestination
+	}
+
+	route, ok := r.selectRoute(id)
+	if !ok {
+		return nil, ErrUnreachable
+	}
+	if len(route) - 1 > maxPathLength {
+		log.Printf(log.WARN, "Route to [% X] has %d hops; max %d\n", id, len(route) - 1,
+		           maxPathLength)
+		return nil, ErrPathTooLong
+	}
+
+	if r.routeCache == nil {
+		r.routeCache = make(map[Eui64][][]byte)
+	}
+	r.routeCache[toEui64(id)] = route
+	return route, nil
+}
+
+// Clears cached routes after a change to the routing table
+func (r *Router) invalidateRoutes() {
+	r.routeCache = nil
+}
@@ -0,0 +1,50 @@
+package router
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestSourceRoute(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	updateLink(r, rootId[:], moteA, 1, 0xFF)
+	updateLink(r, moteA, moteB, 1, 0xFF)
+	updateLink(r, rootId[:], moteC, 1, 0xFF)
+
+	route, err := r.SourceRoute(moteB)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{rootId[:], moteA, moteB}, route)
+	assert.Equal(t, 1, len(r.routeCache))
+
+	// parent change invalidates cache
+	updateLink(r, moteC, moteB, 2, 0xFF)
+	assert.Nil(t, r.routeCache)
+	route, err = r.SourceRoute(moteB)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{rootId[:], moteC, moteB}, route)
+
+	// refresh with same parent keeps cache
+	updateLink(r, moteC, moteB, 3, 0xFF)
+	assert.Equal(t, 1, len(r.routeCache))
+
+	_, err = r.SourceRoute(moteD)
+	assert.Equal(t, ErrUnknownDestination, err)
+
+	SetMaxPathLength(1)
+	_, err = r.SourceRoute(moteB)
+	assert.Equal(t, ErrPathTooLong, err)
+	takeEvents()
+}
+
+func TestSourceRouteUnreachable(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	updateLink(r, rootId[:], moteA, 1, 0xFF)
+	nodeA, _ := r.findNode(moteA)
+	// remove link without pruning the node
+	r.removeLink(nodeA.parents[0])
+
+	_, err := r.SourceRoute(moteA)
+	assert.Equal(t, ErrUnreachable, err)
+}
@@ -16,43 +16,52 @@ const (
 	RPI_FLAG_MASK      byte = 0x1F
 	RPI_O_FLAG         byte = 0x10
 	RPI_R_FLAG         byte = 0x08
+	RPI_F_FLAG         byte = 0x04
 	RPI_I_FLAG         byte = 0x02
 	RPI_K_FLAG         byte = 0x01
 	// there is no IANA for IPV6 HEADER right now, we use NHC identifier for it
 	// https://tools.ietf.org/html/rfc6282#section-4.2
 	IPV6_HEADER        byte = 0xEE
+	IANA_UDP           byte = 0x11
+	IPHC_TF_4B         byte = 0
+	IPHC_TF_3B         byte = 1
+	IPHC_TF_1B         byte = 2
 	IPHC_TF_ELIDED     byte = 3
 	IPHC_NH_INLINE     byte = 0
+	IPHC_HLIM_INLINE   byte = 0
+	IPHC_HLIM_1        byte = 1
 	IPHC_HLIM_64       byte = 2
+	IPHC_HLIM_255      byte = 3
 	IPHC_CID_NONE      byte = 0
+	IPHC_SAC_STATELESS byte = 0
 	IPHC_SAC_STATEFUL  byte = 1
+	IPHC_SAM_128B      byte = 0
 	IPHC_SAM_64B       byte = 1
+	IPHC_SAM_16B       byte = 2
+	IPHC_SAM_ELIDED    byte = 3
 	IPHC_DAC_STATEFUL  byte = 1
 	IPHC_DAM_64B       byte = 1
-
-	RPL_TYPE_TRANSIT_INFORMATION byte = 0x06
-	RPL_TYPE_TARGET_INFORMATION byte  = 0x05
+	NHC_UDP_MASK       byte = 0xF8
+	NHC_UDP_ID         byte = 0xF0
+	NHC_UDP_C_FLAG     byte = 0x04
+	NHC_UDP_PORTS_MASK byte = 0x03
 )
 
 var (
 	NETWORK_PREFIX  = [8]byte{0xBB, 0xBB, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-	RootNode RplNode
+	LINK_LOCAL_PREFIX = [8]byte{0xFE, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
 )
 
-// Container for parsed IP header contents
+// Container for parsed IP header contents. LinkSource and LinkDest are the
+// 802.15.4 addresses from the frame, used to reconstruct elided IP addresses.
 type IpData struct {
 	Source [16]byte
 	Dest [16]byte
+	LinkSource [8]byte
+	LinkDest [8]byte
 	Fields map[string]int
 }
 
-// Routing table
-type RplNode struct {
-	Id []byte
-	sequence int
-	children []RplNode
-}
-
 /*
 Reads a data packet from the root node, and returns a map of 6LoWPAN field data
 found. Initializes provided IpData as needed.
@@ -70,6 +79,9 @@ func ReadData(ip *IpData, preHop byte, data []byte) (err error) {
 	// Expect 6LoWPAN adaptation header to begin with a parsing context switch
 	// to Page 1.
 	i := 0
+	if err = checkLength(data, i, 2, "6LoWPAN header"); err != nil {
+		return
+	}
 	if data[i] == PAGE_ONE_DISPATCH {
 		// RFC 8138
 		// Read 6LoRH-RPI (critical) 0b100xxxxx header.
@@ -79,13 +91,26 @@ func ReadData(ip *IpData, preHop byte, data []byte) (err error) {
 		// |1|0|0|O|R|F|I|K| 6LoRH Type=5  |   Compressed fields  |
 		// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+  ...  -+-+-+
 		i++
+		if err = checkLength(data, i, 2, "6LoRH"); err != nil {
+			return
+		}
 		if (data[i] & MASK_6LoRH == CRITICAL_6LoRH) && (data[i+1] == TYPE_6LoRH_RPI) {
 			ip.Fields["next_header"] = int(IANA_IPv6HOPHEADER)
 			// RPI flags in the 5 least signficiant bits of the first byte.
 			ip.Fields["hop_flags"] = int(data[i] & RPI_FLAG_MASK)
 			i += 2
 
-			// Next 0 or 1 byte is RPL Instance ID
+			// Next 0 or 1 byte is RPL Instance ID, then 1 or 2 bytes rank
+			rpiLen := 3
+			if ip.Fields["hop_flags"] & int(RPI_I_FLAG) != 0 {
+				rpiLen--
+			}
+			if ip.Fields["hop_flags"] & int(RPI_K_FLAG) != 0 {
+				rpiLen--
+			}
+			if err = checkLength(data, i, rpiLen, "6LoRH RPI"); err != nil {
+				return
+			}
 			if ip.Fields["hop_flags"] & int(RPI_I_FLAG) == 0 {
 				ip.Fields["hop_rplInstanceID"] = int(data[i])
 				i++
@@ -127,171 +152,257 @@ func ReadData(ip *IpData, preHop byte, data []byte) (err error) {
 
 		// next byte after IPHC header
 		i = 2
+		// Context Identifier extension; only context 0 (NETWORK_PREFIX) is known
+		cid := (data[1] >> 7) & 0x1
+		if cid != IPHC_CID_NONE {
+			if err = checkLength(data, i, 1, "IPHC context"); err != nil {
+				return
+			}
+			if data[i] != 0 {
+				log.Printf(log.WARN, "unsupported IPHC context 0x%X\n", data[i])
+			}
+			i++
+		}
+
 		// Traffic Class and Flow Label
 		tf := (data[0] >> 3) & 0x3
-		if tf == IPHC_TF_ELIDED {
+		tfLen := [...]int{4, 3, 1, 0}[tf]
+		if err = checkLength(data, i, tfLen, "IPHC traffic class"); err != nil {
+			return
+		}
+		switch tf {
+		case IPHC_TF_4B:
+			// ECN and DSCP are reordered relative to the IPv6 Traffic Class
+			ip.Fields["traffic_class"] = int((data[i] & 0x3F) << 2 | data[i] >> 6)
+			ip.Fields["flow_label"] = (int(data[i+1] & 0x0F) << 16) + (int(data[i+2]) << 8) +
+			                          int(data[i+3])
+			i += 4
+		case IPHC_TF_3B:
+			ip.Fields["traffic_class"] = int(data[i] >> 6)
+			ip.Fields["flow_label"] = (int(data[i] & 0x0F) << 16) + (int(data[i+1]) << 8) +
+			                          int(data[i+2])
+			i += 3
+		case IPHC_TF_1B:
+			ip.Fields["traffic_class"] = int((data[i] & 0x3F) << 2 | data[i] >> 6)
+			ip.Fields["flow_label"] = 0
+			i++
+		case IPHC_TF_ELIDED:
+			ip.Fields["traffic_class"] = 0
 			ip.Fields["flow_label"] = 0
-		} else {
-			log.Println(log.WARN, "unsupported IPHC TF value")
 		}
 
-		// Next Header
+		// Next Header; if compressed, read NHC below, after the addresses
 		nh := (data[0] >> 2) & 0x1
 		if nh == IPHC_NH_INLINE {
+			if err = checkLength(data, i, 1, "IPHC next header"); err != nil {
+				return
+			}
 			ip.Fields["next_header"] = int(data[i])
 			i++
-		} else {
-			log.Println(log.WARN, "unsupported IPHC NH value")
 		}
 
 		// Hop limit
 		hlim := data[0] & 0x3
-		if hlim == IPHC_HLIM_64 {
+		switch hlim {
+		case IPHC_HLIM_INLINE:
+			if err = checkLength(data, i, 1, "IPHC hop limit"); err != nil {
+				return
+			}
+			ip.Fields["hop_limit"] = int(data[i])
+			i++
+		case IPHC_HLIM_1:
+			ip.Fields["hop_limit"] = 1
+		case IPHC_HLIM_64:
 			ip.Fields["hop_limit"] = 64
-		} else {
-			log.Println(log.WARN, "unsupported IPHC HLIM value")
+		case IPHC_HLIM_255:
+			ip.Fields["hop_limit"] = 255
 		}
 
-		// Context Identifier extension
-		cid := (data[1] >> 7) & 0x1
-		if cid != IPHC_CID_NONE {
-			log.Println(log.WARN, "unsupported IPHC CID value")
-		}
-
-		// Source Address Compression
+		// Source Address Compression and Mode
 		sac := (data[1] >> 6) & 0x1
-		if sac == IPHC_SAC_STATEFUL {
-			copy(ip.Source[:8], NETWORK_PREFIX[:])
-		} else {
-			log.Println(log.WARN, "unsupported IPHC SAC value")
-		}
-
-		// Source Address Mode
 		sam := (data[1] >> 4) & 0x3
-		if sam == IPHC_SAM_64B {
-			copy(ip.Source[8:16], data[i:i+8])
-			i += 8
-		} else {
-			log.Println(log.WARN, "unsupported IPHC SAM value")
+		i, err = readIphcAddress(&ip.Source, sac, sam, &ip.LinkSource, data, i)
+		if err != nil {
+			return
 		}
 
-		// Multicast Compression (ignored)
-
-		// Destination Address Compression
+		// Destination Address Compression and Mode
+		multicast := (data[1] >> 3) & 0x1
 		dac := (data[1] >> 2) & 0x1
-		if dac == IPHC_DAC_STATEFUL {
-			copy(ip.Dest[:8], NETWORK_PREFIX[:])
-		} else {
-			log.Println(log.WARN, "unsupported IPHC DAC value")
-		}
-
-		// Destination Address Mode
 		dam := data[1] & 0x3
-		if dam == IPHC_DAM_64B {
-			copy(ip.Dest[8:16], data[i:i+8])
-			i += 8
+		if multicast == 1 {
+			i, err = readIphcMulticast(&ip.Dest, dac, dam, data, i)
+			if err != nil {
+				return
+			}
+		} else if (dac == IPHC_DAC_STATEFUL) && (dam == 0) {
+			err = errors.New("reserved IPHC DAC/DAM value")
+			return
 		} else {
-			log.Println(log.WARN, "unsupported IPHC DAM value")
+			i, err = readIphcAddress(&ip.Dest, dac, dam, &ip.LinkDest, data, i)
+			if err != nil {
+				return
+			}
 		}
 
-		// Next header
-		// Skip IPHC_NH_COMPRESSED handling; unsupported presently
-		// Skip next header is hop-by-hop handling; unsupported presently
+		// Next header compression; only UDP supported
+		if nh != IPHC_NH_INLINE {
+			if err = checkLength(data, i, 1, "NHC header"); err != nil {
+				return
+			}
+			if (data[i] & NHC_UDP_MASK) != NHC_UDP_ID {
+				err = errors.New(fmt.Sprintf("unsupported NHC header 0x%X", data[i]))
+				return
+			}
+			i, err = readNhcUdp(ip, data, i)
+			if err != nil {
+				return
+			}
+		}
 	}
 
 	// payload
 	ip.Fields["version"] = 6
-	ip.Fields["traffic_class"] = 0
 	ip.Fields["payload"] = i
 	ip.Fields["payload_length"] = len(data) - i
 
 	return
 }
 
-func InitRootNode(id [8]byte) {
-	RootNode = RplNode{Id: id[:], children: make([]RplNode, 0)}
-	log.Printf(log.INFO, "Created root node [% X]\n", id)
-}
-
-func ReadRpl(source *[16]byte, data []byte) {
-	// skip DAO header, except DAOSequence
-	sequence := int(data[3])
-	i := 20
-	log.Printf(log.INFO, "DAO from [% X]", source[8:])
-	for i < len(data) {
-		if data[i] == RPL_TYPE_TRANSIT_INFORMATION {
-			// skip transit info header
-			i += 6
-			log.Printf(log.INFO, "parent [% X]", data[i+8:i+16])
-			updateDownlink(data[i+8:i+16], source[8:], sequence)
-			i += 16
-		} else if data[i] == RPL_TYPE_TARGET_INFORMATION {
-			// skip target header
-			i += 4
-			log.Printf(log.INFO, "child [% X]", data[i+8:i+16])
-			i += 16
+/*
+Reads a unicast IPHC address into addr, for the provided address compression
+and mode. Returns the index in data following the address, or an error if data
+is too short for the address. An address elided entirely is rebuilt from the
+link layer address, which OpenWSN uses directly as the interface identifier.
+*/
+func readIphcAddress(addr *[16]byte, ac byte, am byte, linkAddr *[8]byte, data []byte,
+                     i int) (int, error) {
+	prefix := LINK_LOCAL_PREFIX
+	if ac == IPHC_SAC_STATEFUL {
+		if am == IPHC_SAM_128B {
+			// unspecified address
+			*addr = [16]byte{}
+			return i, nil
 		}
+		prefix = NETWORK_PREFIX
 	}
-}
 
-// Verify ID matches node's ID
-func isNodeId(node *RplNode, id []byte) (bool) {
-	if len(id) != len(node.Id) {
-		return false
+	addrLen := [...]int{16, 8, 2, 0}[am]
+	if err := checkLength(data, i, addrLen, "IPHC address"); err != nil {
+		return i, err
 	}
-	for i, b := range node.Id {
-		if b != id[i] {
-			return false
-		}
+	switch am {
+	case IPHC_SAM_128B:
+		copy(addr[:], data[i:i+16])
+		return i+16, nil
+	case IPHC_SAM_64B:
+		copy(addr[:8], prefix[:])
+		copy(addr[8:], data[i:i+8])
+		return i+8, nil
+	case IPHC_SAM_16B:
+		// RFC 6282, sec. 3.2.2: 0000:00ff:fe00:XXXX
+		copy(addr[:8], prefix[:])
+		copy(addr[8:], []byte{0x00, 0x00, 0x00, 0xFF, 0xFE, 0x00, data[i], data[i+1]})
+		return i+2, nil
+	default:
+		copy(addr[:8], prefix[:])
+		copy(addr[8:], linkAddr[:])
+		return i, nil
 	}
-	return true
 }
 
-// recursive search for child with id, rooted at parent
-func findNode(parent *RplNode, id []byte) (*RplNode, bool) {
-	for i := range parent.children {
-		child := &parent.children[i]
-		if isNodeId(child, id) {
-			return child, true
-		}
+// Reads a multicast IPHC destination address into addr. Returns the index in
+// data following the address.
+func readIphcMulticast(addr *[16]byte, dac byte, dam byte, data []byte, i int) (int, error) {
+	if dac == IPHC_DAC_STATEFUL {
+		return i, errors.New("unsupported IPHC stateful multicast address")
 	}
-	for i := range parent.children {
-		child := &parent.children[i]
-		if node, ok := findNode(child, id); ok {
-			return node, ok
-		}
+	addrLen := [...]int{16, 6, 4, 1}[dam]
+	if err := checkLength(data, i, addrLen, "IPHC multicast address"); err != nil {
+		return i, err
+	}
+
+	*addr = [16]byte{0xFF}
+	switch dam {
+	case 0:
+		copy(addr[:], data[i:i+16])
+		return i+16, nil
+	case 1:
+		// ffXX::00XX:XXXX:XXXX
+		addr[1] = data[i]
+		copy(addr[11:], data[i+1:i+6])
+		return i+6, nil
+	case 2:
+		// ffXX::00XX:XXXX
+		addr[1] = data[i]
+		copy(addr[13:], data[i+1:i+4])
+		return i+4, nil
+	default:
+		// ff02::00XX
+		addr[1] = 0x02
+		addr[15] = data[i]
+		return i+1, nil
 	}
-	return nil, false
 }
 
-// Update routing table for parent->child downlink
-func updateDownlink(parentId []byte, childId []byte, sequence int) {
-	if isNodeId(&RootNode, parentId) {
-		updateForChild(&RootNode, childId, sequence)
+/*
+Reads a UDP header compressed with NHC, RFC 6282 sec. 4.3. Returns the index in
+data following the compressed header, which is the start of the UDP payload, or
+an error if data is too short for the header. The UDP length is not carried in
+the header, so it must be derived later from "payload_length".
+
+   0   1   2   3   4   5   6   7
+ +---+---+---+---+---+---+---+---+
+ | 1 | 1 | 1 | 1 | 0 | C |   P   |
+ +---+---+---+---+---+---+---+---+
+*/
+func readNhcUdp(ip *IpData, data []byte, i int) (int, error) {
+	nhc := data[i]
+	i++
+	udpLen := [...]int{4, 3, 3, 1}[nhc & NHC_UDP_PORTS_MASK]
+	if (nhc & NHC_UDP_C_FLAG) == 0 {
+		udpLen += 2
+	}
+	if err := checkLength(data, i, udpLen, "NHC UDP header"); err != nil {
+		return i, err
+	}
+	ip.Fields["next_header"] = int(IANA_UDP)
+
+	switch nhc & NHC_UDP_PORTS_MASK {
+	case 0:
+		ip.Fields["udp_src_port"] = (int(data[i]) << 8) + int(data[i+1])
+		ip.Fields["udp_dest_port"] = (int(data[i+2]) << 8) + int(data[i+3])
+		i += 4
+	case 1:
+		ip.Fields["udp_src_port"] = (int(data[i]) << 8) + int(data[i+1])
+		ip.Fields["udp_dest_port"] = 0xF000 + int(data[i+2])
+		i += 3
+	case 2:
+		ip.Fields["udp_src_port"] = 0xF000 + int(data[i])
+		ip.Fields["udp_dest_port"] = (int(data[i+1]) << 8) + int(data[i+2])
+		i += 3
+	case 3:
+		ip.Fields["udp_src_port"] = 0xF0B0 + int(data[i] >> 4)
+		ip.Fields["udp_dest_port"] = 0xF0B0 + int(data[i] & 0x0F)
+		i++
+	}
+
+	if (nhc & NHC_UDP_C_FLAG) == 0 {
+		ip.Fields["udp_checksum"] = (int(data[i]) << 8) + int(data[i+1])
+		ip.Fields["udp_checksum_elided"] = 0
+		i += 2
 	} else {
-		if parent, ok := findNode(&RootNode, parentId); ok {
-			updateForChild(parent, childId, sequence)
-		} else {
-			log.Printf(log.ERROR, "Can't find link parent [% X]\n", parentId)
-		}
+		ip.Fields["udp_checksum"] = 0
+		ip.Fields["udp_checksum_elided"] = 1
 	}
+	return i, nil
 }
 
-// Update routing table
-func updateForChild(parent *RplNode, childId []byte, sequence int) {
-	for i := range parent.children {
-		child := &parent.children[i]
-		if isNodeId(child, childId) {
-			if child.sequence != sequence {
-				child.sequence = sequence
-				log.Printf(log.INFO, "update parent [% X] -> child [% X] DAO sequence to %d\n",
-				           parent.Id, child.Id, sequence)
-			}
-			return
-		}
+// Returns an error if data does not hold n bytes for field, starting at index i
+func checkLength(data []byte, i int, n int, field string) error {
+	if len(data) < i + n {
+		return errors.New(fmt.Sprintf("%s truncated; need %d bytes at %d, length %d", field,
+		                              n, i, len(data)))
 	}
-
-	parent.children = append(parent.children,
-							 RplNode{Id: childId, children: make([]RplNode, 0)})
-	log.Printf(log.INFO, "added parent [% X] -> child [% X]\n", parent.Id, childId)
+	return nil
 }
@@ -49,12 +49,34 @@ func TestIphc(t *testing.T) {
 	assert.Equal(t, dest, ip.Dest)
 }
 
-// Tests reading RPL DAO; data[4:23]
+// Tests reading RPL DAO; data[23:]
 func TestRpl(t *testing.T) {
+	resetRouters(t)
 	ip:= new(IpData)
 	err := ReadData(ip, 0x78, data)
 	err = ReadData(ip, 0x78, data[4:])
 	assert.Nil(t, err)
-	ReadRpl(&ip.Source, data[27:])
+	err = ReadIcmpv6(ip, data[23:])
+	assert.Nil(t, err)
+	assert.Equal(t, int(ICMPv6_TYPE_RPL), ip.Fields["icmpv6_type"])
+	assert.Equal(t, int(RPL_CODE_DAO), ip.Fields["icmpv6_code"])
 }
 
+
+// Tests that a frame truncated within a header returns an error rather than panic
+func TestTruncated(t *testing.T) {
+	ip:= new(IpData)
+	// 6LoRH-RPI
+	for n := 0; n < 4; n++ {
+		assert.NotNil(t, ReadData(ip, 0x78, data[:n]), "length %d", n)
+	}
+	// IPHC
+	for n := 0; n < 19; n++ {
+		assert.NotNil(t, ReadData(ip, 0x78, data[4:4+n]), "length %d", n)
+	}
+	// IPHC with NHC UDP
+	for n := 0; n < 25; n++ {
+		assert.NotNil(t, ReadData(ip, 0x78, udpData[:n]), "length %d", n)
+	}
+	assert.Nil(t, ReadData(ip, 0x78, udpData[:25]))
+}
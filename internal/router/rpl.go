@@ -0,0 +1,418 @@
+package router
+
+// Reads RPL control messages, RFC 6550 sec. 6.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/kb2ma/daghead/internal/log"
+)
+
+const (
+	RPL_CODE_DIS     byte = 0x00
+	RPL_CODE_DIO     byte = 0x01
+	RPL_CODE_DAO     byte = 0x02
+	RPL_CODE_DAO_ACK byte = 0x03
+
+	RPL_DIO_G_FLAG     byte = 0x80
+	RPL_DIO_MOP_MASK   byte = 0x38
+	RPL_DIO_PRF_MASK   byte = 0x07
+	RPL_DAO_K_FLAG     byte = 0x80
+	RPL_DAO_D_FLAG     byte = 0x40
+	// RFC 9914; Projected DAO
+	RPL_DAO_P_FLAG     byte = 0x20
+	RPL_DAO_ACK_D_FLAG byte = 0x80
+
+	RPL_DIS_LEN     int = 2
+	RPL_DIO_LEN     int = 24
+	RPL_DAO_LEN     int = 4
+	RPL_DAO_ACK_LEN int = 4
+	DODAGID_LEN     int = 16
+)
+
+// DODAG Information Solicitation base object
+type RplDis struct {
+	Flags byte
+}
+
+// DODAG Information Object base object
+type RplDio struct {
+	InstanceId byte
+	Version byte
+	Rank int
+	Grounded bool
+	// Mode of Operation
+	Mop byte
+	// DODAG preference
+	Prf byte
+	// Destination Advertisement Trigger Sequence Number
+	Dtsn byte
+	Flags byte
+	DodagId [16]byte
+}
+
+// Destination Advertisement Object base object. DodagId is valid only if
+// HasDodagId (the D flag) is set.
+type RplDao struct {
+	InstanceId byte
+	// K flag; DAO-ACK requested
+	WantsAck bool
+	HasDodagId bool
+	Sequence byte
+	DodagId [16]byte
+}
+
+// Destination Advertisement Object Acknowledgement base object. DodagId is
+// valid only if HasDodagId (the D flag) is set.
+type RplDaoAck struct {
+	InstanceId byte
+	HasDodagId bool
+	Sequence byte
+	Status byte
+	DodagId [16]byte
+}
+
+/*
+Reads an RPL control message with the provided ICMPv6 code, from the source in
+ip. The data begins with the message base object. Returns an error for a secure
+or unknown message code, or for a message that can't be read.
+
+For a DAO with the K flag, records a DAO-ACK to send, which rejects the DAO if
+the source is not allowed or the DAO can't be read into the routing table.
+*/
+func ReadRpl(ip *IpData, code byte, data []byte) error {
+	switch code {
+	case RPL_CODE_DIS:
+		dis, i, err := ReadDis(data)
+		if err != nil {
+			return err
+		}
+		opts, err := ReadRplOptions(data[i:])
+		if err != nil {
+			return err
+		}
+		log.Printf(log.INFO, "DIS from [% X], flags 0x%X, solicited info count %d\n",
+		           ip.Source[8:], dis.Flags, len(opts.SolicitedInfo))
+	case RPL_CODE_DIO:
+		dio, i, err := ReadDio(data)
+		if err != nil {
+			return err
+		}
+		opts, err := ReadRplOptions(data[i:])
+		if err != nil {
+			return err
+		}
+		log.Printf(log.INFO, "DIO from [% X], instance %d, version %d, rank %d\n",
+		           ip.Source[8:], dio.InstanceId, dio.Version, dio.Rank)
+		tableLock.Lock()
+		r := getRouter(dio.InstanceId, &dio.DodagId)
+		if opts.DodagConfig != nil {
+			log.Printf(log.DEBUG, "DIO config, MinHopRankIncrease %d, lifetime unit %d\n",
+			           opts.DodagConfig.MinHopRankIncrease, opts.DodagConfig.LifetimeUnit)
+			r.setLifetimeUnit(opts.DodagConfig.LifetimeUnit)
+			r.setMinHopRankIncrease(opts.DodagConfig.MinHopRankIncrease)
+		}
+		r.updateVersion(dio.Version)
+		r.updateMop(dio.Mop)
+		r.updateRank(ip.Source[8:], dio.Rank)
+		events := takeEvents()
+		tableLock.Unlock()
+		emitEvents(events)
+	case RPL_CODE_DAO:
+		dao, i, err := ReadDao(data)
+		if err != nil {
+			return err
+		}
+		opts, err := ReadRplOptions(data[i:])
+		if err != nil {
+			return err
+		}
+		var dodagId *[16]byte
+		if dao.HasDodagId {
+			dodagId = &dao.DodagId
+		}
+		tableLock.Lock()
+		r := getRouter(dao.InstanceId, dodagId)
+		status := DAO_ACK_ACCEPT
+		if !isDaoAllowed(ip.Source[8:]) {
+			err = errors.New(fmt.Sprintf("rejected DAO from [% X], not in allowlist",
+			                             ip.Source[8:]))
+		} else {
+			err = r.readDaoOptions(&ip.Source, dao, opts)
+		}
+		if err != nil {
+			status = DAO_ACK_REJECT
+		}
+		if dao.WantsAck {
+			var route [][]byte
+			if status == DAO_ACK_REJECT {
+				route = r.rejectRoute(ip.Source[8:], opts)
+			}
+			r.queueAck(ip.Source[8:], dao, status, route)
+		}
+		events := takeEvents()
+		tableLock.Unlock()
+		emitEvents(events)
+		if err != nil {
+			return err
+		}
+	case RPL_CODE_DAO_ACK:
+		ack, _, err := ReadDaoAck(data)
+		if err != nil {
+			return err
+		}
+		log.Printf(log.INFO, "DAO-ACK from [% X], sequence %d, status %d\n", ip.Source[8:],
+		           ack.Sequence, ack.Status)
+		tableLock.Lock()
+		ackTracks(ip.Source[8:], ack)
+		tableLock.Unlock()
+	default:
+		return errors.New(fmt.Sprintf("unsupported RPL code 0x%X from [% X]", code,
+		                              ip.Source[8:]))
+	}
+	return nil
+}
+
+/*
+Reads a DIS base object. Returns the index in data of the options that follow.
+
+  0                   1
+  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ |     Flags     |   Reserved    |   Option(s)...
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+*/
+func ReadDis(data []byte) (*RplDis, int, error) {
+	if len(data) < RPL_DIS_LEN {
+		return nil, 0, errors.New(fmt.Sprintf("DIS too short %d", len(data)))
+	}
+	return &RplDis{Flags: data[0]}, RPL_DIS_LEN, nil
+}
+
+/*
+Reads a DIO base object. Returns the index in data of the options that follow.
+
+  0                   1                   2                   3
+  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ | RPLInstanceID |Version Number |             Rank              |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ |G|0| MOP | Prf |     DTSN      |     Flags     |   Reserved    |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ |                            DODAGID (16 bytes)                 |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+*/
+func ReadDio(data []byte) (*RplDio, int, error) {
+	if len(data) < RPL_DIO_LEN {
+		return nil, 0, errors.New(fmt.Sprintf("DIO too short %d", len(data)))
+	}
+	dio := &RplDio{InstanceId: data[0], Version: data[1],
+	               Rank: (int(data[2]) << 8) + int(data[3]),
+	               Grounded: (data[4] & RPL_DIO_G_FLAG) != 0,
+	               Mop: (data[4] & RPL_DIO_MOP_MASK) >> 3,
+	               Prf: data[4] & RPL_DIO_PRF_MASK,
+	               Dtsn: data[5], Flags: data[6]}
+	copy(dio.DodagId[:], data[8:24])
+	return dio, RPL_DIO_LEN, nil
+}
+
+/*
+Reads a DAO base object. Returns the index in data of the options that follow.
+
+  0                   1                   2                   3
+  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ | RPLInstanceID |K|D|   Flags   |   Reserved    | DAOSequence   |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ |                  DODAGID (16 bytes, if D flag)                |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+*/
+func ReadDao(data []byte) (*RplDao, int, error) {
+	if len(data) < RPL_DAO_LEN {
+		return nil, 0, errors.New(fmt.Sprintf("DAO too short %d", len(data)))
+	}
+	dao := &RplDao{InstanceId: data[0], WantsAck: (data[1] & RPL_DAO_K_FLAG) != 0,
+	               HasDodagId: (data[1] & RPL_DAO_D_FLAG) != 0, Sequence: data[3]}
+	i := RPL_DAO_LEN
+	if dao.HasDodagId {
+		if len(data) < i + DODAGID_LEN {
+			return nil, 0, errors.New(fmt.Sprintf("DAO too short for DODAGID %d", len(data)))
+		}
+		copy(dao.DodagId[:], data[i:i+DODAGID_LEN])
+		i += DODAGID_LEN
+	}
+	return dao, i, nil
+}
+
+/*
+Reads a DAO-ACK base object. Returns the index in data of the options that follow.
+
+  0                   1                   2                   3
+  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ | RPLInstanceID |D|  Reserved   |  DAOSequence  |    Status     |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ |                  DODAGID (16 bytes, if D flag)                |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+*/
+func ReadDaoAck(data []byte) (*RplDaoAck, int, error) {
+	if len(data) < RPL_DAO_ACK_LEN {
+		return nil, 0, errors.New(fmt.Sprintf("DAO-ACK too short %d", len(data)))
+	}
+	ack := &RplDaoAck{InstanceId: data[0], HasDodagId: (data[1] & RPL_DAO_ACK_D_FLAG) != 0,
+	                  Sequence: data[2], Status: data[3]}
+	i := RPL_DAO_ACK_LEN
+	if ack.HasDodagId {
+		if len(data) < i + DODAGID_LEN {
+			return nil, 0, errors.New(fmt.Sprintf("DAO-ACK too short for DODAGID %d",
+			                                      len(data)))
+		}
+		copy(ack.DodagId[:], data[i:i+DODAGID_LEN])
+		i += DODAGID_LEN
+	}
+	return ack, i, nil
+}
+
+// Returns true if any of the transits includes a parent address
+func hasParentTransit(transits []RplTransit) bool {
+	for _, transit := range transits {
+		if transit.HasParent {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Updates the next-hop table from a DAO group with no parent addresses, from a
+child of the root in storing mode. The child is the next hop for each Target,
+or for itself if the group has no Target.
+*/
+func (r *Router) readStoringGroup(sourceId []byte, group *RplDaoGroup) {
+	targets := group.Targets
+	if len(targets) == 0 {
+		targets = []RplTarget{{PrefixLen: 128, Prefix: NodeAddress(sourceId)}}
+	}
+	for k := range targets {
+		for j := range group.Transits {
+			r.updateNextHop(sourceId, &targets[k], &group.Transits[j])
+		}
+	}
+}
+
+/*
+Updates the routing table from the Target and Transit options in a DAO. Each
+Transit applies to all of the Targets in its group, or to the DAO source if the
+group has no Target. The Transits for a target describe all of its parents,
+except that a Transit with a zero Path Lifetime (No-Path) removes the link to
+that parent. A Target other than the source's own address is a prefix route
+attached to the source. The routing table must be locked.
+
+In storing mode, a group with no parent address in its Transits updates the
+next-hop table instead, with the source as the next hop.
+
+Returns an error if the DAOSequence is older than the last DAO from the source.
+*/
+func (r *Router) readDaoOptions(source *[16]byte, dao *RplDao, opts *RplOptions) error {
+	sourceId := source[8:]
+	log.Printf(log.INFO, "DAO from [% X], sequence %d", sourceId, dao.Sequence)
+
+	if node, ok := r.findNode(sourceId); ok && (node.daoSequence != NO_SEQUENCE) {
+		last := byte(node.daoSequence)
+		if IsSequenceReset(dao.Sequence, last) {
+			log.Printf(log.INFO, "DAO sequence for [% X] reset from %d to %d\n", sourceId, last,
+			           dao.Sequence)
+			// path sequence also restarts
+			node.pathSequence = NO_SEQUENCE
+			r.queueEvent(Event{Type: EVENT_MOTE_RESET, NodeId: node.Id})
+		} else {
+			switch CompareSequence(dao.Sequence, last) {
+			case SEQ_LESS:
+				return errors.New(fmt.Sprintf("stale DAO sequence %d from [% X]; last %d",
+				                              dao.Sequence, sourceId, last))
+			case SEQ_NOT_COMPARABLE:
+				log.Printf(log.WARN, "DAO sequence %d from [% X] not comparable to %d\n",
+				           dao.Sequence, sourceId, last)
+			}
+		}
+	}
+
+	// parent links for each target, in the order targets are found
+	var targets [][]byte
+	updates := make(map[Eui64][]linkUpdate)
+	// other prefixes to attach to the source, with the transits for each
+	var prefixes []RplTarget
+	var prefixTransits [][]RplTransit
+	for _, group := range opts.DaoGroups {
+		if r.isStoring() && !hasParentTransit(group.Transits) {
+			r.readStoringGroup(sourceId, &group)
+			continue
+		}
+		groupTargets := make([][]byte, 0, len(group.Targets))
+		for k := range group.Targets {
+			// slice of Prefix below must not refer to a loop variable
+			target := &group.Targets[k]
+			if (target.PrefixLen != 128) || !bytes.Equal(target.Prefix[8:], sourceId) {
+				log.Printf(log.INFO, "prefix [% X]/%d", target.Prefix, target.PrefixLen)
+				prefixes = append(prefixes, *target)
+				prefixTransits = append(prefixTransits, group.Transits)
+				continue
+			}
+			log.Printf(log.INFO, "child [% X]", target.Prefix[8:])
+			groupTargets = append(groupTargets, target.Prefix[8:])
+		}
+		if len(group.Targets) == 0 {
+			groupTargets = append(groupTargets, source[8:])
+		}
+
+		for _, transit := range group.Transits {
+			if !transit.HasParent {
+				log.Printf(log.WARN, "No parent address in transit from [% X]\n", source[8:])
+				continue
+			}
+			log.Printf(log.INFO, "parent [% X], path control 0x%X, lifetime %d",
+			           transit.Parent[8:], transit.PathControl, transit.PathLifetime)
+			for _, target := range groupTargets {
+				key := toEui64(target)
+				if _, ok := updates[key]; !ok {
+					targets = append(targets, target)
+				}
+				updates[key] = append(updates[key],
+				                      linkUpdate{parentId: transit.Parent[8:],
+				                                 pathControl: transit.PathControl,
+				                                 pathSequence: transit.PathSequence,
+				                                 lifetime: transit.PathLifetime})
+			}
+		}
+	}
+
+	for _, target := range targets {
+		var links, noPaths []linkUpdate
+		for _, update := range updates[toEui64(target)] {
+			if update.lifetime == NO_PATH_LIFETIME {
+				noPaths = append(noPaths, update)
+			} else {
+				links = append(links, update)
+			}
+		}
+		r.removeLinks(target, noPaths)
+		r.updateLinks(target, links)
+	}
+
+	node, ok := r.findNode(sourceId)
+	if !ok {
+		if len(prefixes) > 0 {
+			log.Printf(log.WARN, "Ignoring %d prefixes from [% X], not in routing table\n",
+			           len(prefixes), sourceId)
+		}
+		return nil
+	}
+	for i := range prefixes {
+		for j := range prefixTransits[i] {
+			r.updatePrefix(node, &prefixes[i], &prefixTransits[i][j])
+		}
+	}
+	node.daoSequence = int(dao.Sequence)
+	return nil
+}
@@ -0,0 +1,376 @@
+package router
+
+// Reads the options in an RPL control message, RFC 6550 sec. 6.7.
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kb2ma/daghead/internal/log"
+)
+
+const (
+	RPL_TYPE_PAD1                   byte = 0x00
+	RPL_TYPE_PADN                   byte = 0x01
+	RPL_TYPE_DAG_METRIC_CONTAINER   byte = 0x02
+	RPL_TYPE_ROUTE_INFORMATION      byte = 0x03
+	RPL_TYPE_DODAG_CONFIGURATION    byte = 0x04
+	RPL_TYPE_TARGET_INFORMATION     byte = 0x05
+	RPL_TYPE_TRANSIT_INFORMATION    byte = 0x06
+	RPL_TYPE_SOLICITED_INFORMATION  byte = 0x07
+	RPL_TYPE_PREFIX_INFORMATION     byte = 0x08
+	RPL_TYPE_TARGET_DESCRIPTOR      byte = 0x09
+	// RFC 9914; Via Information options
+	RPL_TYPE_SM_VIO                 byte = 0x0E
+	RPL_TYPE_SR_VIO                 byte = 0x0F
+
+	RPL_TRANSIT_E_FLAG byte = 0x80
+	RPL_SOLICITED_V_FLAG byte = 0x80
+	RPL_SOLICITED_I_FLAG byte = 0x40
+	RPL_SOLICITED_D_FLAG byte = 0x20
+	RPL_CONFIG_A_FLAG byte = 0x08
+	RPL_CONFIG_PCS_MASK byte = 0x07
+	RPL_PREFIX_L_FLAG byte = 0x80
+	RPL_PREFIX_A_FLAG byte = 0x40
+	RPL_PREFIX_R_FLAG byte = 0x20
+
+	RPL_TRANSIT_LEN        int = 4
+	RPL_TRANSIT_PARENT_LEN int = 20
+	RPL_SOLICITED_LEN      int = 19
+	RPL_CONFIG_LEN         int = 14
+	RPL_PREFIX_LEN         int = 30
+	RPL_ROUTE_LEN          int = 6
+	RPL_DESCRIPTOR_LEN     int = 4
+)
+
+// RPL Target option, and any Target Descriptor that follows it
+type RplTarget struct {
+	PrefixLen int
+	Prefix [16]byte
+	HasDescriptor bool
+	Descriptor uint32
+}
+
+// Transit Information option. Parent is valid only if HasParent, as in
+// non-storing mode.
+type RplTransit struct {
+	External bool
+	PathControl byte
+	PathSequence byte
+	PathLifetime byte
+	HasParent bool
+	Parent [16]byte
+}
+
+// Solicited Information option from a DIS
+type RplSolicitedInfo struct {
+	InstanceId byte
+	// V, I, D predicate flags
+	Flags byte
+	DodagId [16]byte
+	Version byte
+}
+
+// DODAG Configuration option from a DIO
+type RplDodagConfig struct {
+	AuthEnabled bool
+	// Path Control Size
+	Pcs byte
+	DioIntDoublings byte
+	DioIntMin byte
+	DioRedundancy byte
+	MaxRankIncrease int
+	MinHopRankIncrease int
+	// Objective Code Point
+	Ocp int
+	DefaultLifetime byte
+	LifetimeUnit int
+}
+
+// Prefix Information option from a DIO
+type RplPrefixInfo struct {
+	PrefixLen int
+	OnLink bool
+	Autonomous bool
+	RouterAddress bool
+	ValidLifetime uint32
+	PreferredLifetime uint32
+	Prefix [16]byte
+}
+
+// Route Information option from a DIO
+type RplRouteInfo struct {
+	PrefixLen int
+	Preference byte
+	RouteLifetime uint32
+	Prefix [16]byte
+}
+
+/*
+A set of Target options followed by the set of Transit options that applies
+to them, RFC 6550 sec. 9.4. Targets is empty if the DAO includes Transit
+options with no preceding Target, in which case the target is the DAO source.
+*/
+type RplDaoGroup struct {
+	Targets []RplTarget
+	Transits []RplTransit
+}
+
+// Options read from an RPL control message
+type RplOptions struct {
+	DaoGroups []RplDaoGroup
+	DodagConfig *RplDodagConfig
+	SolicitedInfo []RplSolicitedInfo
+	PrefixInfo []RplPrefixInfo
+	RouteInfo []RplRouteInfo
+	// Contents of DAG Metric Container options, not interpreted
+	MetricContainers [][]byte
+}
+
+/*
+Reads the options in an RPL control message. Each option is read using its
+length field, so an option of unknown type is skipped. Returns an error if an
+option is truncated or shorter than its type requires.
+
+   0                   1                   2
+   0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8
+  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+- - - - - - - -
+  |  Option Type  | Option Length | Option Data
+  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+- - - - - - - -
+*/
+func ReadRplOptions(data []byte) (*RplOptions, error) {
+	opts := new(RplOptions)
+	// true if the last Target/Transit option read was a Transit
+	isInTransits := false
+	i := 0
+
+	for i < len(data) {
+		optType := data[i]
+		if optType == RPL_TYPE_PAD1 {
+			i++
+			continue
+		}
+		if i+2 > len(data) {
+			return nil, errors.New(fmt.Sprintf("RPL option 0x%X truncated", optType))
+		}
+		optLen := int(data[i+1])
+		if i+2+optLen > len(data) {
+			return nil, errors.New(fmt.Sprintf("RPL option 0x%X length %d truncated", optType,
+			                                   optLen))
+		}
+		optData := data[i+2:i+2+optLen]
+		i += 2 + optLen
+
+		var err error
+		switch optType {
+		case RPL_TYPE_PADN:
+			// skip
+		case RPL_TYPE_DAG_METRIC_CONTAINER:
+			opts.MetricContainers = append(opts.MetricContainers, optData)
+		case RPL_TYPE_ROUTE_INFORMATION:
+			var route *RplRouteInfo
+			if route, err = readRouteInfo(optData); err == nil {
+				opts.RouteInfo = append(opts.RouteInfo, *route)
+			}
+		case RPL_TYPE_DODAG_CONFIGURATION:
+			opts.DodagConfig, err = readDodagConfig(optData)
+		case RPL_TYPE_TARGET_INFORMATION:
+			var target *RplTarget
+			if target, err = readTarget(optData); err == nil {
+				if isInTransits || (len(opts.DaoGroups) == 0) {
+					opts.DaoGroups = append(opts.DaoGroups, RplDaoGroup{})
+					isInTransits = false
+				}
+				group := &opts.DaoGroups[len(opts.DaoGroups)-1]
+				group.Targets = append(group.Targets, *target)
+			}
+		case RPL_TYPE_TRANSIT_INFORMATION:
+			var transit *RplTransit
+			if transit, err = readTransit(optData); err == nil {
+				if len(opts.DaoGroups) == 0 {
+					opts.DaoGroups = append(opts.DaoGroups, RplDaoGroup{})
+				}
+				group := &opts.DaoGroups[len(opts.DaoGroups)-1]
+				group.Transits = append(group.Transits, *transit)
+				isInTransits = true
+			}
+		case RPL_TYPE_SOLICITED_INFORMATION:
+			var info *RplSolicitedInfo
+			if info, err = readSolicitedInfo(optData); err == nil {
+				opts.SolicitedInfo = append(opts.SolicitedInfo, *info)
+			}
+		case RPL_TYPE_PREFIX_INFORMATION:
+			var prefix *RplPrefixInfo
+			if prefix, err = readPrefixInfo(optData); err == nil {
+				opts.PrefixInfo = append(opts.PrefixInfo, *prefix)
+			}
+		case RPL_TYPE_TARGET_DESCRIPTOR:
+			err = readTargetDescriptor(opts, isInTransits, optData)
+		default:
+			log.Printf(log.DEBUG, "Skipping unknown RPL option 0x%X, len %d\n", optType, optLen)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return opts, nil
+}
+
+/*
+Reads a Target option. The prefix is variable length, as required by the
+prefix length.
+
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ |     Flags     | Prefix Length |   Target Prefix (Variable Length)
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+*/
+func readTarget(data []byte) (*RplTarget, error) {
+	if len(data) < 2 {
+		return nil, errors.New(fmt.Sprintf("RPL Target option too short %d", len(data)))
+	}
+	target := &RplTarget{PrefixLen: int(data[1])}
+	prefixBytes := (target.PrefixLen + 7) / 8
+	if (target.PrefixLen > 128) || (len(data) < 2 + prefixBytes) {
+		return nil, errors.New(fmt.Sprintf("RPL Target prefix length %d not valid",
+		                                   target.PrefixLen))
+	}
+	copy(target.Prefix[:], data[2:2+prefixBytes])
+	return target, nil
+}
+
+// Reads a Target Descriptor option into the Target that precedes it
+func readTargetDescriptor(opts *RplOptions, isInTransits bool, data []byte) error {
+	if len(data) < RPL_DESCRIPTOR_LEN {
+		return errors.New(fmt.Sprintf("RPL Target Descriptor too short %d", len(data)))
+	}
+	if isInTransits || (len(opts.DaoGroups) == 0) {
+		return errors.New("RPL Target Descriptor does not follow a Target")
+	}
+	group := &opts.DaoGroups[len(opts.DaoGroups)-1]
+	target := &group.Targets[len(group.Targets)-1]
+	target.HasDescriptor = true
+	target.Descriptor = readUint32(data)
+	return nil
+}
+
+/*
+Reads a Transit Information option. The parent address is present only in
+non-storing mode.
+
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ |E|    Flags    | Path Control  | Path Sequence | Path Lifetime |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ |                 Parent Address* (16 bytes)                    |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+*/
+func readTransit(data []byte) (*RplTransit, error) {
+	if len(data) < RPL_TRANSIT_LEN {
+		return nil, errors.New(fmt.Sprintf("RPL Transit option too short %d", len(data)))
+	}
+	transit := &RplTransit{External: (data[0] & RPL_TRANSIT_E_FLAG) != 0,
+	                       PathControl: data[1], PathSequence: data[2],
+	                       PathLifetime: data[3]}
+	if len(data) >= RPL_TRANSIT_PARENT_LEN {
+		transit.HasParent = true
+		copy(transit.Parent[:], data[4:20])
+	}
+	return transit, nil
+}
+
+/*
+Reads a Solicited Information option.
+
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ | RPLInstanceID |V|I|D|  Flags  |      DODAGID (16 bytes) ...   |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ |Version Number |
+ +-+-+-+-+-+-+-+-+
+*/
+func readSolicitedInfo(data []byte) (*RplSolicitedInfo, error) {
+	if len(data) < RPL_SOLICITED_LEN {
+		return nil, errors.New(fmt.Sprintf("RPL Solicited Info option too short %d", len(data)))
+	}
+	info := &RplSolicitedInfo{InstanceId: data[0], Flags: data[1], Version: data[18]}
+	copy(info.DodagId[:], data[2:18])
+	return info, nil
+}
+
+/*
+Reads a DODAG Configuration option.
+
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ |Flags|A| PCS | DIOIntDoubl.  |  DIOIntMin.   |   DIORedun.   |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ |        MaxRankIncrease        |     MinHopRankIncrease        |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ |              OCP              |   Reserved    | Def. Lifetime |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ |      Lifetime Unit            |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+*/
+func readDodagConfig(data []byte) (*RplDodagConfig, error) {
+	if len(data) < RPL_CONFIG_LEN {
+		return nil, errors.New(fmt.Sprintf("RPL DODAG Config option too short %d", len(data)))
+	}
+	return &RplDodagConfig{AuthEnabled: (data[0] & RPL_CONFIG_A_FLAG) != 0,
+	                       Pcs: data[0] & RPL_CONFIG_PCS_MASK,
+	                       DioIntDoublings: data[1], DioIntMin: data[2], DioRedundancy: data[3],
+	                       MaxRankIncrease: (int(data[4]) << 8) + int(data[5]),
+	                       MinHopRankIncrease: (int(data[6]) << 8) + int(data[7]),
+	                       Ocp: (int(data[8]) << 8) + int(data[9]),
+	                       DefaultLifetime: data[11],
+	                       LifetimeUnit: (int(data[12]) << 8) + int(data[13])}, nil
+}
+
+/*
+Reads a Prefix Information option.
+
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ | Prefix Length |L|A|R|Reserved1|         Valid Lifetime ...    |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ | ...           |       Preferred Lifetime      | Reserved2 ... |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ | ...           |          Prefix (16 bytes) ...                |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+*/
+func readPrefixInfo(data []byte) (*RplPrefixInfo, error) {
+	if len(data) < RPL_PREFIX_LEN {
+		return nil, errors.New(fmt.Sprintf("RPL Prefix Info option too short %d", len(data)))
+	}
+	prefix := &RplPrefixInfo{PrefixLen: int(data[0]),
+	                         OnLink: (data[1] & RPL_PREFIX_L_FLAG) != 0,
+	                         Autonomous: (data[1] & RPL_PREFIX_A_FLAG) != 0,
+	                         RouterAddress: (data[1] & RPL_PREFIX_R_FLAG) != 0,
+	                         ValidLifetime: readUint32(data[2:6]),
+	                         PreferredLifetime: readUint32(data[6:10])}
+	copy(prefix.Prefix[:], data[14:30])
+	return prefix, nil
+}
+
+/*
+Reads a Route Information option.
+
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ | Prefix Length |Resvd|Prf|Resvd|        Route Lifetime ...     |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+ | ...                           |   Prefix (Variable Length)    |
+ +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+*/
+func readRouteInfo(data []byte) (*RplRouteInfo, error) {
+	if len(data) < RPL_ROUTE_LEN {
+		return nil, errors.New(fmt.Sprintf("RPL Route Info option too short %d", len(data)))
+	}
+	route := &RplRouteInfo{PrefixLen: int(data[0]), Preference: (data[1] >> 3) & 0x03,
+	                       RouteLifetime: readUint32(data[2:6])}
+	prefixBytes := (route.PrefixLen + 7) / 8
+	if (route.PrefixLen > 128) || (len(data) < RPL_ROUTE_LEN + prefixBytes) {
+		return nil, errors.New(fmt.Sprintf("RPL Route Info prefix length %d not valid",
+		                                   route.PrefixLen))
+	}
+	copy(route.Prefix[:], data[RPL_ROUTE_LEN:RPL_ROUTE_LEN+prefixBytes])
+	return route, nil
+}
+
+func readUint32(data []byte) uint32 {
+	return (uint32(data[0]) << 24) + (uint32(data[1]) << 16) + (uint32(data[2]) << 8) +
+	       uint32(data[3])
+}
@@ -0,0 +1,80 @@
+package router
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+// Pad1, PadN, two Targets (second with descriptor) and a Transit, then a Target
+// and Transit, then an unknown option
+var optionData = []byte{
+0x00, 0x01, 0x02, 0x00, 0x00,
+0x05, 0x12, 0x00, 0x80, 0xBB, 0xBB, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+0x05, 0x0A, 0x00, 0x40, 0xBB, 0xBB, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+0x09, 0x04, 0x00, 0x00, 0x01, 0x02,
+0x06, 0x14, 0x00, 0x00, 0x05, 0xAA, 0xBB, 0xBB, 0x00, 0x00, 0x00, 0x00,
+0x00, 0x00, 0x46, 0x1D, 0x52, 0x44, 0x7B, 0x43, 0x76, 0x78,
+0x05, 0x12, 0x00, 0x80, 0xBB, 0xBB, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02,
+0x06, 0x04, 0x80, 0x00, 0x06, 0x00,
+0x7F, 0x02, 0xFF, 0xFF,
+}
+
+func TestReadRplOptions(t *testing.T) {
+	opts, err := ReadRplOptions(optionData)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(opts.DaoGroups))
+
+	group := opts.DaoGroups[0]
+	assert.Equal(t, 2, len(group.Targets))
+	assert.Equal(t, 128, group.Targets[0].PrefixLen)
+	assert.Equal(t, byte(0x01), group.Targets[0].Prefix[15])
+	assert.False(t, group.Targets[0].HasDescriptor)
+	assert.Equal(t, 64, group.Targets[1].PrefixLen)
+	assert.True(t, group.Targets[1].HasDescriptor)
+	assert.Equal(t, uint32(0x0102), group.Targets[1].Descriptor)
+	assert.Equal(t, 1, len(group.Transits))
+	assert.True(t, group.Transits[0].HasParent)
+	assert.Equal(t, byte(5), group.Transits[0].PathSequence)
+	assert.Equal(t, byte(0xAA), group.Transits[0].PathLifetime)
+	assert.Equal(t, byte(0x78), group.Transits[0].Parent[15])
+
+	group = opts.DaoGroups[1]
+	assert.Equal(t, 1, len(group.Targets))
+	assert.Equal(t, 1, len(group.Transits))
+	assert.True(t, group.Transits[0].External)
+	assert.False(t, group.Transits[0].HasParent)
+}
+
+// Tests DAO in router_test.go, with a Transit and no Target
+func TestReadRplOptionsTransitOnly(t *testing.T) {
+	opts, err := ReadRplOptions(data[47:])
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(opts.DaoGroups))
+	assert.Equal(t, 0, len(opts.DaoGroups[0].Targets))
+	assert.Equal(t, 1, len(opts.DaoGroups[0].Transits))
+}
+
+func TestReadDodagConfig(t *testing.T) {
+	opts, err := ReadRplOptions([]byte{0x04, 0x0E, 0x00, 0x08, 0x0C, 0x0A, 0x07, 0x00,
+	                                   0x01, 0x00, 0x00, 0x01, 0x00, 0xFF, 0x00, 0x3C})
+	assert.Nil(t, err)
+	assert.Equal(t, 256, opts.DodagConfig.MinHopRankIncrease)
+	assert.Equal(t, 1792, opts.DodagConfig.MaxRankIncrease)
+	assert.Equal(t, 1, opts.DodagConfig.Ocp)
+	assert.Equal(t, byte(0xFF), opts.DodagConfig.DefaultLifetime)
+	assert.Equal(t, 60, opts.DodagConfig.LifetimeUnit)
+}
+
+func TestReadRplOptionsInvalid(t *testing.T) {
+	// truncated PadN
+	_, err := ReadRplOptions([]byte{0x01, 0x04, 0x00})
+	assert.NotNil(t, err)
+	// Transit too short
+	_, err = ReadRplOptions([]byte{0x06, 0x02, 0x00, 0x00})
+	assert.NotNil(t, err)
+	// Target Descriptor without Target
+	_, err = ReadRplOptions([]byte{0x09, 0x04, 0x00, 0x00, 0x00, 0x01})
+	assert.NotNil(t, err)
+}
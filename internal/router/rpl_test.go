@@ -0,0 +1,94 @@
+package router
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+var dioData = []byte{
+0x00, 0x02, 0x01, 0x00, 0x88, 0x05, 0x00, 0x00, 0xBB, 0xBB,
+0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x46, 0x1D, 0x52, 0x44,
+0x7B, 0x43, 0x76, 0x78,
+}
+
+func TestReadDio(t *testing.T) {
+	dio, i, err := ReadDio(dioData)
+	assert.Nil(t, err)
+	assert.Equal(t, 24, i)
+	assert.Equal(t, byte(2), dio.Version)
+	assert.Equal(t, 256, dio.Rank)
+	assert.True(t, dio.Grounded)
+	assert.Equal(t, byte(1), dio.Mop)
+	assert.Equal(t, byte(5), dio.Dtsn)
+	assert.Equal(t, byte(0x78), dio.DodagId[15])
+
+	_, _, err = ReadDio(dioData[:20])
+	assert.NotNil(t, err)
+}
+
+func TestReadDao(t *testing.T) {
+	// D flag set
+	dao, i, err := ReadDao(data[27:])
+	assert.Nil(t, err)
+	assert.Equal(t, 20, i)
+	assert.True(t, dao.HasDodagId)
+	assert.False(t, dao.WantsAck)
+	assert.Equal(t, byte(1), dao.Sequence)
+
+	// K flag set, no DODAGID
+	dao, i, err = ReadDao([]byte{0x00, 0x80, 0x00, 0x07})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, i)
+	assert.False(t, dao.HasDodagId)
+	assert.True(t, dao.WantsAck)
+	assert.Equal(t, byte(7), dao.Sequence)
+
+	// D flag set, but no DODAGID
+	_, _, err = ReadDao([]byte{0x00, 0x40, 0x00, 0x07})
+	assert.NotNil(t, err)
+}
+
+func TestReadDaoAck(t *testing.T) {
+	ack, i, err := ReadDaoAck([]byte{0x00, 0x00, 0x07, 0x80})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, i)
+	assert.Equal(t, byte(7), ack.Sequence)
+	assert.Equal(t, byte(0x80), ack.Status)
+}
+
+// Tests rejection of unknown ICMPv6 type and secure RPL code
+func TestIcmpv6Unsupported(t *testing.T) {
+	resetRouters(t)
+	ip := &IpData{Fields: make(map[string]int)}
+	assert.NotNil(t, ReadIcmpv6(ip, []byte{0x86, 0x00, 0x00, 0x00}))
+	assert.NotNil(t, ReadIcmpv6(ip, []byte{ICMPv6_TYPE_RPL, 0x82, 0x00, 0x00, 0x00}))
+	assert.NotNil(t, ReadIcmpv6(ip, []byte{ICMPv6_TYPE_RPL, 0x02}))
+	assert.Nil(t, ReadIcmpv6(ip, []byte{ICMPv6_TYPE_ECHO_REPLY, 0x00, 0x00, 0x00}))
+}
+
+// Tests rejection of a stale DAO, and detection of a reset DAO sequence
+func TestDaoSequence(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	var events []Event
+	SetEventHandler(func(event Event) {
+		events = append(events, event)
+	})
+
+	dao := make([]byte, len(data)-23)
+	copy(dao, data[23:])
+	ip := &IpData{Fields: make(map[string]int)}
+	copy(ip.Source[8:], moteA)
+	assert.Nil(t, ReadIcmpv6(ip, dao))
+	_, ok := r.findNode(moteA)
+	assert.True(t, ok)
+
+	// DAOSequence at dao[7]
+	dao[7] = 0
+	assert.NotNil(t, ReadIcmpv6(ip, dao))
+
+	dao[7] = SEQUENCE_INIT
+	assert.Nil(t, ReadIcmpv6(ip, dao))
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, EVENT_MOTE_RESET, events[0].Type)
+}
@@ -0,0 +1,102 @@
+package router
+
+// Lollipop sequence counters, RFC 6550 sec. 7.2, used for the DAOSequence, the
+// Path Sequence and the DODAG Version Number.
+
+const (
+	SEQUENCE_WINDOW = 16
+	// Initial value for a lollipop counter, 256 - SEQUENCE_WINDOW
+	SEQUENCE_INIT byte = 240
+	// Values above this limit are in the linear region, at or below in the circular
+	SEQUENCE_CIRCULAR_MAX byte = 127
+	// Sequence value not yet known
+	NO_SEQUENCE int = -1
+)
+
+// Result of comparing two sequence counters
+type SeqOrder int
+
+const (
+	SEQ_LESS SeqOrder = iota
+	SEQ_EQUAL
+	SEQ_GREATER
+	// counters are desynchronized, so the comparison is not valid
+	SEQ_NOT_COMPARABLE
+)
+
+/*
+Compares lollipop sequence counter a to b. For example, returns SEQ_GREATER if a
+is greater than b.
+*/
+func CompareSequence(a byte, b byte) SeqOrder {
+	if a == b {
+		return SEQ_EQUAL
+	}
+	aLinear := a > SEQUENCE_CIRCULAR_MAX
+	bLinear := b > SEQUENCE_CIRCULAR_MAX
+
+	if aLinear != bLinear {
+		// One counter still in linear region, the other has wrapped into the
+		// circular region.
+		linear, circular := int(a), int(b)
+		if bLinear {
+			linear, circular = int(b), int(a)
+		}
+		circularIsGreater := (256 + circular - linear) <= SEQUENCE_WINDOW
+		if circularIsGreater == aLinear {
+			return SEQ_LESS
+		}
+		return SEQ_GREATER
+	}
+
+	diff := int(a) - int(b)
+	if aLinear {
+		if (diff > SEQUENCE_WINDOW) || (diff < -SEQUENCE_WINDOW) {
+			return SEQ_NOT_COMPARABLE
+		}
+		if diff > 0 {
+			return SEQ_GREATER
+		}
+		return SEQ_LESS
+	}
+
+	// circular region; serial number arithmetic with SERIAL_BITS = 7
+	if diff < 0 {
+		diff += 128
+	}
+	// diff now is the distance from b forward to a, in (0, 128)
+	if diff <= SEQUENCE_WINDOW {
+		return SEQ_GREATER
+	}
+	if (128 - diff) <= SEQUENCE_WINDOW {
+		return SEQ_LESS
+	}
+	return SEQ_NOT_COMPARABLE
+}
+
+/*
+Returns true if a newly received counter indicates that the sender restarted
+the counter from its initial value, as after a reboot. The received counter is
+in the linear region, and either is greater than a last counter that has wrapped
+into the circular region, or is not comparable to the last counter.
+*/
+func IsSequenceReset(received byte, last byte) bool {
+	if received <= SEQUENCE_CIRCULAR_MAX {
+		return false
+	}
+	order := CompareSequence(received, last)
+	if last <= SEQUENCE_CIRCULAR_MAX {
+		return order == SEQ_GREATER
+	}
+	return order == SEQ_NOT_COMPARABLE
+}
+
+// Returns the value that follows seq, wrapping from the linear region into the
+// circular region
+func IncrementSequence(seq byte) byte {
+	if seq > SEQUENCE_CIRCULAR_MAX {
+		// wraps from 255 to 0
+		return seq + 1
+	}
+	return (seq + 1) & SEQUENCE_CIRCULAR_MAX
+}
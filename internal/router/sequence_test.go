@@ -0,0 +1,41 @@
+package router
+
+import (
+  "testing"
+  "github.com/stretchr/testify/assert"
+)
+
+func TestCompareSequence(t *testing.T) {
+	// linear region
+	assert.Equal(t, SEQ_GREATER, CompareSequence(241, 240))
+	assert.Equal(t, SEQ_LESS, CompareSequence(240, 241))
+	assert.Equal(t, SEQ_NOT_COMPARABLE, CompareSequence(200, 240))
+	// circular region, including wrap
+	assert.Equal(t, SEQ_EQUAL, CompareSequence(5, 5))
+	assert.Equal(t, SEQ_GREATER, CompareSequence(6, 5))
+	assert.Equal(t, SEQ_GREATER, CompareSequence(2, 125))
+	assert.Equal(t, SEQ_LESS, CompareSequence(125, 2))
+	assert.Equal(t, SEQ_NOT_COMPARABLE, CompareSequence(5, 60))
+	// linear to circular
+	assert.Equal(t, SEQ_GREATER, CompareSequence(3, 250))
+	assert.Equal(t, SEQ_LESS, CompareSequence(250, 3))
+	// restart into linear region
+	assert.Equal(t, SEQ_GREATER, CompareSequence(240, 50))
+	assert.Equal(t, SEQ_LESS, CompareSequence(50, 240))
+}
+
+func TestIsSequenceReset(t *testing.T) {
+	assert.True(t, IsSequenceReset(240, 50))
+	assert.True(t, IsSequenceReset(240, 200))
+	assert.False(t, IsSequenceReset(241, 240))
+	assert.False(t, IsSequenceReset(250, 3))
+	assert.False(t, IsSequenceReset(51, 50))
+}
+
+func TestIncrementSequence(t *testing.T) {
+	assert.Equal(t, byte(241), IncrementSequence(240))
+	assert.Equal(t, byte(0), IncrementSequence(255))
+	assert.Equal(t, byte(1), IncrementSequence(0))
+	assert.Equal(t, byte(0), IncrementSequence(127))
+	assert.Equal(t, SEQ_GREATER, CompareSequence(IncrementSequence(255), 255))
+}
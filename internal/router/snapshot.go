@@ -0,0 +1,152 @@
+package router
+
+/*
+Consistent copies of a routing table, for readers outside of the DAO handling,
+like an API, metrics or a CLI. A snapshot shares no memory with the routing
+table, so it may be read without locking while the table continues to change.
+*/
+
+import (
+	"bytes"
+	"sort"
+	"time"
+)
+
+// Copy of a link to a parent
+type LinkSnapshot struct {
+	ParentId []byte
+	PathControl byte
+	Lifetime byte
+	// zero if the link does not expire
+	Expires time.Time
+	Suspect bool
+	ErrorCount int
+	// configured rather than learned from DAOs
+	Static bool
+	// restored from a saved routing table, and not yet refreshed by a DAO
+	Stale bool
+}
+
+// Copy of a node in the routing table. Sequence values are NO_SEQUENCE until known.
+type NodeSnapshot struct {
+	Id []byte
+	DaoSequence int
+	PathSequence int
+	// links to parents, most preferred first
+	Parents []LinkSnapshot
+	ChildIds [][]byte
+	Prefixes []PrefixRoute
+	// NO_RANK until known; the root's rank is MinHopRankIncrease
+	Rank int
+	// zero if no rank received
+	RankUpdated time.Time
+	// hops in the selected route from the root, or -1 if not reachable
+	HopDepth int
+	// compared with the routing table when the snapshot was taken
+	RankFlags RankFlags
+}
+
+// Copy of the routing table for a DODAG
+type Snapshot struct {
+	Key DodagKey
+	// NO_SEQUENCE if not known
+	Version int
+	MinHopRankIncrease int
+	// Mode of Operation
+	Mop byte
+	// nil if the root mote is not known
+	RootId []byte
+	// sorted by Id
+	Nodes []NodeSnapshot
+	Pending []PendingLink
+	// storing mode routes, sorted by prefix
+	NextHops []NextHopRoute
+	// projected routes, in the order created
+	Tracks []ProjectedRoute
+	Taken time.Time
+}
+
+// Returns a snapshot of the routing table
+func (r *Router) Snapshot() *Snapshot {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	return r.snapshot()
+}
+
+// Returns snapshots of the routing tables for all routers, in the order created
+func Snapshots() []*Snapshot {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	snaps := make([]*Snapshot, len(routers))
+	for i, r := range routers {
+		snaps[i] = r.snapshot()
+	}
+	return snaps
+}
+
+// Returns a snapshot of the routing table; the routing table must be locked
+func (r *Router) snapshot() *Snapshot {
+	snap := &Snapshot{Key: r.key, Version: r.version,
+	                  MinHopRankIncrease: r.minHopRankIncrease, Mop: r.mop, Taken: time.Now(),
+	                  Nodes: make([]NodeSnapshot, 0, len(r.nodes)),
+	                  Pending: make([]PendingLink, len(r.pendingLinks))}
+	if r.rootNode != nil {
+		snap.RootId = copyId(r.rootNode.Id)
+	}
+	for _, node := range r.nodes {
+		nodeSnap := node.snapshot()
+		nodeSnap.Rank = r.rankOf(node)
+		nodeSnap.HopDepth = r.hopDepth(node)
+		nodeSnap.RankFlags = r.rankFlags(node)
+		snap.Nodes = append(snap.Nodes, nodeSnap)
+	}
+	sort.Slice(snap.Nodes, func(i, j int) bool {
+		return bytes.Compare(snap.Nodes[i].Id, snap.Nodes[j].Id) < 0
+	})
+	for i, pending := range r.pendingLinks {
+		snap.Pending[i] = *pending
+		snap.Pending[i].ParentId = copyId(pending.ParentId)
+		snap.Pending[i].ChildId = copyId(pending.ChildId)
+		snap.Pending[i].update.parentId = snap.Pending[i].ParentId
+	}
+	snap.NextHops = r.copyNextHops()
+	snap.Tracks = r.copyTracks()
+	return snap
+}
+
+func (node *RplNode) snapshot() NodeSnapshot {
+	snap := NodeSnapshot{Id: copyId(node.Id), DaoSequence: node.daoSequence,
+	                     PathSequence: node.pathSequence, RankUpdated: node.rankUpdated,
+	                     Parents: make([]LinkSnapshot, len(node.parents)),
+	                     ChildIds: make([][]byte, len(node.children)),
+	                     Prefixes: make([]PrefixRoute, len(node.prefixes))}
+	for i, link := range node.parents {
+		snap.Parents[i] = LinkSnapshot{ParentId: copyId(link.Parent.Id),
+		                               PathControl: link.PathControl, Lifetime: link.lifetime,
+		                               Expires: link.expires, Suspect: link.Suspect,
+		                               ErrorCount: link.ErrorCount, Static: link.Static,
+		                               Stale: link.Stale}
+	}
+	for i, child := range node.children {
+		snap.ChildIds[i] = copyId(child.Id)
+	}
+	for i, route := range node.prefixes {
+		snap.Prefixes[i] = *route
+	}
+	return snap
+}
+
+// Returns the node for id in the snapshot, or nil if not found
+func (snap *Snapshot) Node(id []byte) *NodeSnapshot {
+	i := sort.Search(len(snap.Nodes), func(i int) bool {
+		return bytes.Compare(snap.Nodes[i].Id, id) >= 0
+	})
+	if (i < len(snap.Nodes)) && bytes.Equal(snap.Nodes[i].Id, id) {
+		return &snap.Nodes[i]
+	}
+	return nil
+}
+
+func copyId(id []byte) []byte {
+	return append([]byte{}, id...)
+}
@@ -0,0 +1,85 @@
+package router
+
+import (
+  "sync"
+  "testing"
+  "time"
+  "github.com/stretchr/testify/assert"
+)
+
+// Tests a snapshot is not changed by later updates to the routing table
+func TestSnapshot(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	updateLink(r, rootId[:], moteA, 1, 0xFF)
+	updateLink(r, moteA, moteB, 1, 0xFF)
+	takeEvents()
+
+	snap := r.Snapshot()
+	assert.Equal(t, rootId[:], snap.RootId)
+	assert.Equal(t, 3, len(snap.Nodes))
+	nodeB := snap.Node(moteB)
+	assert.NotNil(t, nodeB)
+	assert.Equal(t, moteA, nodeB.Parents[0].ParentId)
+	assert.Equal(t, 1, nodeB.PathSequence)
+	assert.Equal(t, [][]byte{moteB}, snap.Node(moteA).ChildIds)
+	assert.Nil(t, snap.Node(moteC))
+
+	// move B, and modify an ID in the table
+	updateLink(r, rootId[:], moteB, 2, 0xFF)
+	node, _ := r.findNode(moteA)
+	node.Id[0] = 0
+	assert.Equal(t, moteA, nodeB.Parents[0].ParentId)
+	assert.Equal(t, moteA, snap.Node(moteA).Id)
+	node.Id[0] = moteA[0]
+	takeEvents()
+
+	assert.Equal(t, len(Routers()), len(Snapshots()))
+}
+
+// Tests concurrent updates and reads; run with the race detector
+func TestConcurrentAccess(t *testing.T) {
+	resetRouters(t)
+	InitRootNode(rootId)
+	SetEventHandler(func(event Event) {})
+
+	dao := make([]byte, len(data)-23)
+	copy(dao, data[23:])
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			ip := &IpData{Fields: make(map[string]int)}
+			copy(ip.Source[8:], moteA)
+			msg := append([]byte{}, dao...)
+			// DAOSequence, Path Sequence
+			msg[7] = byte(i)
+			msg[28] = byte(i)
+			ReadIcmpv6(ip, msg)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			for _, snap := range Snapshots() {
+				for _, node := range snap.Nodes {
+					_ = len(node.Parents)
+				}
+			}
+			if r := DefaultRouter(); r != nil {
+				r.SourceRoute(moteA)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			ExpireRoutes(time.Now())
+			RootId()
+		}
+	}()
+	wg.Wait()
+	_, err := DefaultRouter().SourceRoute(moteA)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,166 @@
+package router
+
+/*
+Static routes, configured rather than learned from DAOs, for a mote that does
+not send DAOs, or to pin the parent of a mote with a flaky parent choice.
+
+A static link takes precedence over the links from DAOs. A child with a static
+link keeps only its static parents, so its DAOs refresh its Path Sequence but
+do not change its links. A No-Path or link errors do not remove a static link,
+and static links do not expire. A static link waits until its parent is in the
+routing table, and is restored when its parent returns, as after the parent
+expired or a global repair.
+*/
+
+import (
+	"github.com/kb2ma/daghead/internal/log"
+)
+
+// Configured link from parent to child. A nil ParentId is the root mote.
+type StaticLink struct {
+	ParentId []byte
+	ChildId []byte
+}
+
+// Static links for all routers
+var staticLinks []StaticLink
+
+/*
+Returns the static links along path, from the first mote in the path down to
+the last. A nil ID is the root mote.
+*/
+func StaticPath(path [][]byte) []StaticLink {
+	var links []StaticLink
+	for i := 1; i < len(path); i++ {
+		links = append(links, StaticLink{ParentId: path[i-1], ChildId: path[i]})
+	}
+	return links
+}
+
+/*
+Sets the static links for all routers, and for routers created later. Adds the
+links to the routing tables, for the parents already known.
+*/
+func SetStaticLinks(links []StaticLink) {
+	tableLock.Lock()
+	staticLinks = make([]StaticLink, len(links))
+	for i, link := range links {
+		staticLinks[i] = StaticLink{ChildId: copyId(link.ChildId)}
+		if link.ParentId != nil {
+			staticLinks[i].ParentId = copyId(link.ParentId)
+		}
+	}
+	for _, r := range routers {
+		if r.rootNode == nil {
+			continue
+		}
+		for _, node := range r.copyNodes() {
+			r.attachStatic(node)
+		}
+	}
+	events := takeEvents()
+	tableLock.Unlock()
+
+	emitEvents(events)
+}
+
+// Returns the nodes in the routing table, so the table may change while visiting them
+func (r *Router) copyNodes() []*RplNode {
+	nodes := make([]*RplNode, 0, len(r.nodes))
+	for _, node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// Returns true if the static link is from parent
+func (link *StaticLink) isFrom(r *Router, parent *RplNode) bool {
+	if link.ParentId == nil {
+		return parent == r.rootNode
+	}
+	return isNodeId(parent, link.ParentId)
+}
+
+/*
+Adds the static links from parent, which is in the routing table. A child added
+this way may be the parent for other static or pending links, so also attaches
+those. The routing table must be locked.
+*/
+func (r *Router) attachStatic(parent *RplNode) {
+	added := []*RplNode{parent}
+	for len(added) > 0 {
+		p := added[0]
+		added = added[1:]
+		for _, static := range staticLinks {
+			if !static.isFrom(r, p) {
+				continue
+			}
+			if child, isNew := r.addStaticLink(p, static.ChildId); isNew {
+				added = append(added, child)
+				r.attachPending(child)
+			}
+		}
+	}
+}
+
+/*
+Adds a static link from parent to the child for childId, and removes the
+child's links from DAOs. Returns the child, and true if the child is new to the
+routing table. Returns a nil child if the link would create a loop.
+*/
+func (r *Router) addStaticLink(parent *RplNode, childId []byte) (*RplNode, bool) {
+	child, isKnown := r.findNode(childId)
+	if !isKnown {
+		child = newNode(childId)
+		r.nodes[child.key] = child
+	} else if child == r.rootNode {
+		log.Printf(log.ERROR, "Can't add static link to root [% X]\n", childId)
+		return nil, false
+	} else if (child.findLink(parent) == nil) && isDescendant(parent, child) {
+		r.rejectLoop(child, parent)
+		return nil, false
+	}
+
+	oldParent := child.preferredParent()
+	link := child.findLink(parent)
+	if link == nil {
+		link = &RplLink{Parent: parent, Child: child}
+		parent.children = append(parent.children, child)
+		child.parents = append(child.parents, link)
+		log.Printf(log.INFO, "added static parent [% X] -> child [% X]\n", parent.Id,
+		           child.Id)
+	}
+	link.Static = true
+	link.setLifetime(INFINITE_LIFETIME, r.lifetimeUnit)
+
+	links := child.parents[:0]
+	for _, l := range child.parents {
+		if l.Static {
+			links = append(links, l)
+		} else {
+			l.Parent.removeChild(child)
+			log.Printf(log.INFO, "static parent replaced parent [% X] -> child [% X]\n",
+			           l.Parent.Id, child.Id)
+		}
+	}
+	child.parents = links
+	sortParents(child)
+	r.invalidateRoutes()
+
+	newParent := child.preferredParent()
+	if (oldParent != nil) && (oldParent != newParent) {
+		r.queueEvent(Event{Type: EVENT_PARENT_CHANGED, NodeId: child.Id, ParentId: newParent.Id,
+		                   OldParentId: oldParent.Id})
+	}
+	return child, !isKnown
+}
+
+// Returns true if node has a static link to a parent
+func (node *RplNode) hasStaticParent() bool {
+	for _, link := range node.parents {
+		if link.Static {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package router
+
+import (
+  "testing"
+  "time"
+  "github.com/stretchr/testify/assert"
+)
+
+// Tests static links take precedence over DAOs, and are restored with their parent
+func TestStaticLinks(t *testing.T) {
+	resetRouters(t)
+	links := append(StaticPath([][]byte{nil, moteA, moteB}),
+	                StaticLink{ParentId: moteC, ChildId: moteD})
+	SetStaticLinks(links)
+	r := InitRootNode(rootId)
+	route, err := r.SourceRoute(moteB)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{rootId[:], moteA, moteB}, route)
+	_, ok := r.findNode(moteD)
+	assert.False(t, ok)
+
+	// D attached when C is added
+	updateLink(r, rootId[:], moteC, 1, 10)
+	route, err = r.SourceRoute(moteD)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{rootId[:], moteC, moteD}, route)
+
+	// DAO and No-Path do not move B
+	updateLink(r, moteC, moteB, 2, 0xFF)
+	r.removeLinks(moteB, []linkUpdate{{parentId: moteA, pathSequence: 3}})
+	route, _ = r.SourceRoute(moteB)
+	assert.Equal(t, [][]byte{rootId[:], moteA, moteB}, route)
+	snap := r.Snapshot()
+	assert.Equal(t, 3, snap.Node(moteB).PathSequence)
+	assert.Equal(t, 1, len(snap.Node(moteB).Parents))
+	assert.True(t, snap.Node(moteB).Parents[0].Static)
+	assert.False(t, snap.Node(moteC).Parents[0].Static)
+
+	// static links stay when C expires, and D returns with C
+	ExpireRoutes(time.Now().Add(time.Duration(11 * DEFAULT_LIFETIME_UNIT) * time.Second))
+	_, ok = r.findNode(moteD)
+	assert.False(t, ok)
+	_, ok = r.findNode(moteB)
+	assert.True(t, ok)
+	updateLink(r, rootId[:], moteC, 2, 0xFF)
+	_, ok = r.findNode(moteD)
+	assert.True(t, ok)
+}
+
+// Tests a static link replaces the links from DAOs for a known child
+func TestStaticReplacesDynamic(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	var events []Event
+	SetEventHandler(func(event Event) {
+		events = append(events, event)
+	})
+	updateLink(r, rootId[:], moteA, 1, 0xFF)
+	updateLink(r, rootId[:], moteC, 1, 0xFF)
+	updateLink(r, moteA, moteB, 1, 0xFF)
+
+	SetStaticLinks([]StaticLink{{ParentId: moteC, ChildId: moteB}})
+	route, _ := r.SourceRoute(moteB)
+	assert.Equal(t, [][]byte{rootId[:], moteC, moteB}, route)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, EVENT_PARENT_CHANGED, events[0].Type)
+	assert.Equal(t, moteA, events[0].OldParentId)
+	a, _ := r.findNode(moteA)
+	assert.Equal(t, 0, len(a.children))
+
+	// static link not removed after link errors
+	SetLinkErrorLimit(1)
+	tableLock.Lock()
+	assert.Nil(t, r.reportLinkError(moteC, moteB))
+	tableLock.Unlock()
+	_, err := r.SourceRoute(moteB)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,207 @@
+package router
+
+/*
+Storing mode support, RFC 6550 sec. 9.8. In storing mode each mote keeps routes
+for its subtree, so a DAO travels hop by hop and only reaches the root from the
+root's own children. The Transit in such a DAO has no parent address, and the
+Targets are the motes and prefixes reached through the child that sent it. So
+the root keeps a next-hop table rather than a DAG, and a packet down into the
+mesh needs no source route.
+
+The Mode of Operation is configured, or read from DIOs. A storing mode DODAG
+still accepts a DAO Transit with a parent address into the DAG, for a mote that
+operates in non-storing mode, so the two kinds of routes may be mixed. A route
+through the DAG is preferred.
+*/
+
+import (
+	"bytes"
+	"github.com/kb2ma/daghead/internal/log"
+	"sort"
+	"time"
+)
+
+// Mode of Operation, RFC 6550 sec. 6.3.1
+const (
+	MOP_NO_DOWNWARD       byte = 0
+	MOP_NON_STORING       byte = 1
+	MOP_STORING           byte = 2
+	MOP_STORING_MULTICAST byte = 3
+)
+
+// Route to a DAO Target through a child of the root, in storing mode
+type NextHopRoute struct {
+	Prefix [16]byte
+	PrefixLen int
+	NextHopId []byte
+	// restored from a saved routing table, and not yet refreshed by a DAO
+	Stale bool
+	pathSequence int
+	lifetime byte
+	// zero if the route does not expire
+	expires time.Time
+}
+
+// Key for a route in the next-hop table
+type targetKey struct {
+	prefix [16]byte
+	length int
+}
+
+var (
+	// MOP for a new router, and for a router until it reads a DIO
+	defaultMop = MOP_NON_STORING
+	// If true, a router uses the MOP from DIOs rather than the default
+	mopFromDio = true
+)
+
+/*
+Sets the Mode of Operation for all routers, and for routers created later. If
+fromDio, a router replaces the MOP with the one from a DIO.
+*/
+func SetMop(mop byte, fromDio bool) {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	defaultMop = mop
+	mopFromDio = fromDio
+	for _, r := range routers {
+		r.mop = mop
+	}
+}
+
+// Returns the Mode of Operation for the router
+func (r *Router) Mop() byte {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	return r.mop
+}
+
+// Updates the MOP from a DIO, unless the MOP is configured
+func (r *Router) updateMop(mop byte) {
+	if mop == r.mop {
+		return
+	}
+	if !mopFromDio {
+		log.Printf(log.WARN, "DIO MOP %d for instance %d differs from configured MOP %d\n",
+		           mop, r.key.InstanceId, r.mop)
+		return
+	}
+	log.Printf(log.INFO, "Set MOP to %d for instance %d\n", mop, r.key.InstanceId)
+	r.mop = mop
+	r.invalidateRoutes()
+}
+
+// Returns true if the router operates in storing mode
+func (r *Router) isStoring() bool {
+	return (r.mop == MOP_STORING) || (r.mop == MOP_STORING_MULTICAST)
+}
+
+/*
+Updates the next-hop table from a DAO Target reached through the child of the
+root with nextHopId, using a Transit with no parent address. A No-Path removes
+the route, if still through the same next hop. Ignores a stale Path Sequence.
+The routing table must be locked.
+*/
+func (r *Router) updateNextHop(nextHopId []byte, target *RplTarget, transit *RplTransit) {
+	key := targetKey{prefix: target.Prefix, length: target.PrefixLen}
+	route, ok := r.nextHops[key]
+	if ok && (route.pathSequence != NO_SEQUENCE) &&
+	   (CompareSequence(transit.PathSequence, byte(route.pathSequence)) == SEQ_LESS) {
+		log.Printf(log.WARN, "Ignoring stale path sequence %d for [% X]/%d; last %d\n",
+		           transit.PathSequence, target.Prefix, target.PrefixLen, route.pathSequence)
+		return
+	}
+
+	if transit.PathLifetime == NO_PATH_LIFETIME {
+		if ok && bytes.Equal(route.NextHopId, nextHopId) {
+			delete(r.nextHops, key)
+			r.invalidateRoutes()
+			log.Printf(log.INFO, "No-Path removed [% X]/%d via [% X]\n", target.Prefix,
+			           target.PrefixLen, nextHopId)
+			r.queueEvent(Event{Type: EVENT_ROUTE_REMOVED, NodeId: copyId(route.Prefix[8:]),
+			                   ParentId: route.NextHopId})
+		}
+		return
+	}
+
+	if !ok {
+		route = &NextHopRoute{Prefix: target.Prefix, PrefixLen: target.PrefixLen}
+		if r.nextHops == nil {
+			r.nextHops = make(map[targetKey]*NextHopRoute)
+		}
+		r.nextHops[key] = route
+		log.Printf(log.INFO, "added [% X]/%d via next hop [% X]\n", target.Prefix,
+		           target.PrefixLen, nextHopId)
+	} else if !bytes.Equal(route.NextHopId, nextHopId) {
+		log.Printf(log.INFO, "moved [% X]/%d from next hop [% X] to [% X]\n", target.Prefix,
+		           target.PrefixLen, route.NextHopId, nextHopId)
+		r.queueEvent(Event{Type: EVENT_PARENT_CHANGED, NodeId: copyId(route.Prefix[8:]),
+		                   ParentId: copyId(nextHopId), OldParentId: route.NextHopId})
+	}
+	r.invalidateRoutes()
+	route.NextHopId = copyId(nextHopId)
+	route.Stale = false
+	route.pathSequence = int(transit.PathSequence)
+	route.lifetime = transit.PathLifetime
+	route.expires = expiryTime(transit.PathLifetime, r.lifetimeUnit)
+}
+
+/*
+Returns the route from the root to addr through the next-hop table, as the root
+ID and the next hop ID. Motes along the way route from their own tables, so the
+route has no other hops. Uses longest prefix match if there is no route for the
+address itself.
+*/
+func (r *Router) nextHopRoute(addr *[16]byte) ([][]byte, bool) {
+	route, ok := r.nextHops[targetKey{prefix: *addr, length: 128}]
+	if !ok {
+		longest := -1
+		for _, candidate := range r.nextHops {
+			if (candidate.PrefixLen > longest) &&
+			   matchPrefix(addr, &candidate.Prefix, candidate.PrefixLen) {
+				route = candidate
+				longest = candidate.PrefixLen
+			}
+		}
+		if route == nil {
+			return nil, false
+		}
+	}
+	return [][]byte{r.rootNode.Id, route.NextHopId}, true
+}
+
+// Returns copies of the routes in the next-hop table, sorted by prefix
+func (r *Router) NextHops() []NextHopRoute {
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	return r.copyNextHops()
+}
+
+func (r *Router) copyNextHops() []NextHopRoute {
+	routes := make([]NextHopRoute, 0, len(r.nextHops))
+	for _, route := range r.nextHops {
+		copied := *route
+		copied.NextHopId = copyId(route.NextHopId)
+		routes = append(routes, copied)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if order := bytes.Compare(routes[i].Prefix[:], routes[j].Prefix[:]); order != 0 {
+			return order < 0
+		}
+		return routes[i].PrefixLen < routes[j].PrefixLen
+	})
+	return routes
+}
+
+// Removes next-hop routes that have expired as of now, and emits an
+// EVENT_ROUTE_EXPIRED for each
+func (r *Router) expireNextHops(now time.Time) {
+	for key, route := range r.nextHops {
+		if !route.expires.IsZero() && !now.Before(route.expires) {
+			delete(r.nextHops, key)
+			r.invalidateRoutes()
+			r.queueEvent(Event{Type: EVENT_ROUTE_EXPIRED, NodeId: copyId(route.Prefix[8:]),
+			                   ParentId: route.NextHopId})
+		}
+	}
+}
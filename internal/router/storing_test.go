@@ -0,0 +1,109 @@
+package router
+
+import (
+  "testing"
+  "time"
+  "github.com/stretchr/testify/assert"
+)
+
+// Reads a storing mode DAO from source, a child of the root, for the targets
+func readStoringDao(r *Router, source []byte, sequence byte, lifetime byte,
+                    targets ...RplTarget) error {
+	srcAddr := NodeAddress(source)
+	opts := &RplOptions{DaoGroups: []RplDaoGroup{{Targets: targets,
+		Transits: []RplTransit{{PathSequence: sequence, PathLifetime: lifetime}}}}}
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	return r.readDaoOptions(&srcAddr, &RplDao{Sequence: sequence}, opts)
+}
+
+// Tests the next-hop table in storing mode, mixed with a non-storing DAO
+func TestStoringMode(t *testing.T) {
+	resetRouters(t)
+	SetMop(MOP_STORING, false)
+	r := InitRootNode(rootId)
+	prefix := [16]byte{0x20, 0x01, 0x0D, 0xB8}
+	assert.Nil(t, readStoringDao(r, moteA, 1, 0xFF,
+	                             RplTarget{PrefixLen: 128, Prefix: NodeAddress(moteA)},
+	                             RplTarget{PrefixLen: 128, Prefix: NodeAddress(moteB)},
+	                             RplTarget{PrefixLen: 32, Prefix: prefix}))
+	assert.Equal(t, 3, len(r.NextHops()))
+	_, ok := r.findNode(moteA)
+	assert.False(t, ok)
+
+	route, err := r.SourceRoute(moteB)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{rootId[:], moteA}, route)
+	route, err = r.SourceRoute(moteA)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{rootId[:], moteA}, route)
+	addr := [16]byte{0x20, 0x01, 0x0D, 0xB8, 0x00, 0x01}
+	route, err = r.SourceRouteForAddress(&addr)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{rootId[:], moteA}, route)
+	_, err = r.SourceRoute(moteD)
+	assert.Equal(t, ErrUnknownDestination, err)
+
+	// no source route header through a next hop
+	nextHop, lowpan, err := EncodeDownstream(route, &DownstreamPacket{Dest: NodeAddress(moteB),
+	                                                                   HopLimit: 64})
+	assert.Nil(t, err)
+	assert.Equal(t, moteA, nextHop)
+	assert.Equal(t, TYPE_6LoRH_RPI, lowpan[2])
+
+	// B moves below C
+	assert.Nil(t, readStoringDao(r, moteC, 2, 0xFF,
+	                             RplTarget{PrefixLen: 128, Prefix: NodeAddress(moteB)}))
+	events := takeEvents()
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, EVENT_PARENT_CHANGED, events[0].Type)
+	assert.Equal(t, moteB, events[0].NodeId)
+	assert.Equal(t, moteA, events[0].OldParentId)
+	route, _ = r.SourceRoute(moteB)
+	assert.Equal(t, [][]byte{rootId[:], moteC}, route)
+
+	// stale No-Path from A ignored, then removed by C
+	assert.Nil(t, readStoringDao(r, moteA, 1, NO_PATH_LIFETIME,
+	                             RplTarget{PrefixLen: 128, Prefix: NodeAddress(moteB)}))
+	route, _ = r.SourceRoute(moteB)
+	assert.Equal(t, [][]byte{rootId[:], moteC}, route)
+	assert.Nil(t, readStoringDao(r, moteC, 3, NO_PATH_LIFETIME,
+	                             RplTarget{PrefixLen: 128, Prefix: NodeAddress(moteB)}))
+	_, err = r.SourceRoute(moteB)
+	assert.Equal(t, ErrUnknownDestination, err)
+	takeEvents()
+
+	// D in non-storing mode, through the DAG
+	assert.Nil(t, readPrefixDao(r, moteD, rootId[:], 1, addr, 48, 0xFF))
+	route, err = r.SourceRoute(moteD)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{rootId[:], moteD}, route)
+	// DAG preferred over the next-hop table
+	route, err = r.SourceRouteForAddress(&addr)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{rootId[:], moteD}, route)
+
+	// expiry
+	assert.Nil(t, readStoringDao(r, moteC, 4, 1,
+	                             RplTarget{PrefixLen: 128, Prefix: NodeAddress(moteC)}))
+	assert.Equal(t, 3, len(r.Snapshot().NextHops))
+	ExpireRoutes(time.Now().Add(time.Duration(DEFAULT_LIFETIME_UNIT + 1) * time.Second))
+	assert.Equal(t, 2, len(r.NextHops()))
+}
+
+// Tests the MOP from a DIO, unless configured
+func TestDioMop(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	ip := &IpData{Fields: make(map[string]int)}
+	copy(ip.Source[8:], moteA)
+	dio := append([]byte{}, dioData...)
+	// grounded, MOP 2
+	dio[4] = 0x90
+	assert.Nil(t, ReadRpl(ip, RPL_CODE_DIO, dio))
+	assert.Equal(t, MOP_STORING, r.Mop())
+
+	SetMop(MOP_NON_STORING, false)
+	assert.Nil(t, ReadRpl(ip, RPL_CODE_DIO, dio))
+	assert.Equal(t, MOP_NON_STORING, r.Mop())
+}
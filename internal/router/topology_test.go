@@ -0,0 +1,216 @@
+package router
+
+import (
+  "encoding/binary"
+  "fmt"
+  "math/rand"
+  "testing"
+  "github.com/kb2ma/daghead/internal/log"
+  "github.com/stretchr/testify/assert"
+)
+
+// Mote in a synthetic topology, with the DAO and Path Sequence it sends next
+type topologyMote struct {
+	id []byte
+	parentId []byte
+	sequence byte
+}
+
+/*
+Generates a random topology of count motes below the root. Each mote picks a
+parent from the root and the motes generated before it, so the DAOs may be read
+in order with no pending links. The same seed generates the same topology.
+*/
+func generateTopology(count int, seed int64) []*topologyMote {
+	random := rand.New(rand.NewSource(seed))
+	motes := make([]*topologyMote, count)
+	for i := range motes {
+		id := []byte{0x02, 0x12, 0x4B, 0x00, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(id[4:], uint32(i + 1))
+		parent := random.Intn(i + 1)
+		parentId := rootId[:]
+		if parent > 0 {
+			parentId = motes[parent - 1].id
+		}
+		motes[i] = &topologyMote{id: id, parentId: parentId, sequence: 1}
+	}
+	return motes
+}
+
+// Reads a DAO from mote for its link to its parent, and advances its sequence
+func readTopologyDao(r *Router, mote *topologyMote) error {
+	source := NodeAddress(mote.id)
+	opts := &RplOptions{DaoGroups: []RplDaoGroup{{
+		Targets: []RplTarget{{PrefixLen: 128, Prefix: source}},
+		Transits: []RplTransit{{PathSequence: mote.sequence, PathLifetime: INFINITE_LIFETIME,
+		                        HasParent: true, Parent: NodeAddress(mote.parentId)}}}}}
+	tableLock.Lock()
+	err := r.readDaoOptions(&source, &RplDao{Sequence: mote.sequence}, opts)
+	takeEvents()
+	tableLock.Unlock()
+	mote.sequence = (mote.sequence + 1) & SEQUENCE_CIRCULAR_MAX
+	return err
+}
+
+// Creates a routing table from the DAOs for a generated topology
+func loadTopology(t testing.TB, count int) (*Router, []*topologyMote) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	motes := generateTopology(count, 1)
+	for _, mote := range motes {
+		readTopologyDao(r, mote)
+	}
+	return r, motes
+}
+
+// Tests every mote in a generated topology is added and reachable
+func TestGenerateTopology(t *testing.T) {
+	r, motes := loadTopology(t, 500)
+	assert.Equal(t, 501, len(r.nodes))
+	assert.Equal(t, 0, len(r.pendingLinks))
+	for _, mote := range motes {
+		route, ok := r.selectRoute(mote.id)
+		assert.True(t, ok)
+		assert.Equal(t, mote.parentId, route[len(route)-2])
+	}
+	// repeatable
+	assert.Equal(t, generateTopology(50, 7)[49].parentId, generateTopology(50, 7)[49].parentId)
+}
+
+// Tests removing a link with a large subtree below it
+func TestPruneTopology(t *testing.T) {
+	r, motes := loadTopology(t, 500)
+	node, _ := r.findNode(motes[0].id)
+	tableLock.Lock()
+	r.removeLink(node.parents[0])
+	removed := r.pruneUnreachable(node)
+	takeEvents()
+	tableLock.Unlock()
+
+	assert.Equal(t, 501 - len(removed), len(r.nodes))
+	assert.Equal(t, motes[0].id, removed[0])
+	for _, mote := range motes {
+		if _, ok := r.findNode(mote.id); ok {
+			_, ok = r.selectRoute(mote.id)
+			assert.True(t, ok)
+		}
+	}
+}
+
+// Benchmarks sizes of mesh, to show the cost of a DAO does not grow with the size
+var benchmarkSizes = []int{100, 1000, 5000}
+
+// Benchmarks a periodic DAO that refreshes a mote's link to the same parent
+func BenchmarkDaoRefresh(b *testing.B) {
+	log.SetLevel(log.ERROR)
+	defer log.SetLevel(log.INFO)
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("motes-%d", size), func(b *testing.B) {
+			r, motes := loadTopology(b, size)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := readTopologyDao(r, motes[i % size]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Benchmarks a DAO that moves a mote, and its subtree, to another parent
+func BenchmarkDaoReparent(b *testing.B) {
+	log.SetLevel(log.ERROR)
+	defer log.SetLevel(log.INFO)
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("motes-%d", size), func(b *testing.B) {
+			r, motes := loadTopology(b, size)
+			random := rand.New(rand.NewSource(2))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				mote := motes[random.Intn(size)]
+				mote.parentId = motes[random.Intn(size)].id
+				// avoid a loop, which is logged as an error
+				node, _ := r.findNode(mote.id)
+				parent, _ := r.findNode(mote.parentId)
+				if isDescendant(parent, node) {
+					mote.parentId = rootId[:]
+				}
+				if err := readTopologyDao(r, mote); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Benchmarks a source route lookup, as for downstream traffic, mostly from the cache
+func BenchmarkSourceRoute(b *testing.B) {
+	log.SetLevel(log.ERROR)
+	defer log.SetLevel(log.INFO)
+	for _, size := range benchmarkSizes {
+		b.Run(fmt.Sprintf("motes-%d", size), func(b *testing.B) {
+			r, motes := loadTopology(b, size)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := r.SourceRoute(motes[i % size].id); err == ErrPathTooLong {
+					continue
+				} else if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+/*
+Tests selecting a route below many layers of motes that no longer lead to the
+root, where each mote has every mote in the layer above as a parent. Without
+remembering dead ends, the search would climb every path through the layers.
+*/
+func TestSelectRouteDeadEnds(t *testing.T) {
+	resetRouters(t)
+	r := InitRootNode(rootId)
+	tableLock.Lock()
+	defer tableLock.Unlock()
+	updateLink(r, rootId[:], moteA, 1, 0xFF)
+	updateLink(r, rootId[:], moteB, 1, 0xFF)
+
+	layer := [][]byte{moteA}
+	for i := 0; i < 30; i++ {
+		var next [][]byte
+		for j := 0; j < 3; j++ {
+			id := []byte{0x02, 0x12, 0x4B, 0x00, 0, 0, byte(i), byte(j)}
+			var updates []linkUpdate
+			for _, parentId := range layer {
+				updates = append(updates, linkUpdate{parentId: parentId, pathControl: 0x80,
+				                                     pathSequence: 1, lifetime: 0xFF})
+			}
+			r.updateLinks(id, updates)
+			next = append(next, id)
+		}
+		layer = next
+	}
+	// alternate parent for the bottom mote, least preferred
+	bottom := layer[0]
+	r.updateLinks(bottom, []linkUpdate{{parentId: layer[1], pathControl: 0x80,
+	                                    pathSequence: 2, lifetime: 0xFF},
+	                                   {parentId: moteB, pathControl: 0x01,
+	                                    pathSequence: 2, lifetime: 0xFF}})
+
+	route, ok := r.selectRoute(bottom)
+	assert.True(t, ok)
+	assert.Equal(t, moteA, route[1])
+
+	// remove the link from the root without pruning, so the layers are dead ends
+	nodeA, _ := r.findNode(moteA)
+	r.removeLink(nodeA.parents[0])
+	route, ok = r.selectRoute(bottom)
+	assert.True(t, ok)
+	assert.Equal(t, [][]byte{rootId[:], moteB, bottom}, route)
+	_, ok = r.selectRoute(layer[1])
+	assert.False(t, ok)
+	takeEvents()
+}
@@ -0,0 +1,63 @@
+package main
+
+// Saves the routing tables periodically to a file, to restore them on startup.
+
+import (
+	"github.com/kb2ma/daghead/internal/log"
+	"github.com/kb2ma/daghead/internal/router"
+	"os"
+	"time"
+)
+
+const (
+	DEFAULT_SNAPSHOT_FILE = "daghead.routes"
+	DEFAULT_SNAPSHOT_INTERVAL = 60 * time.Second
+)
+
+/*
+Writes the routing tables to the file at path. Writes a temporary file first
+and renames it, so a crash while writing leaves the last file intact.
+*/
+func saveTables(path string) error {
+	tempPath := path + ".tmp"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	err = router.SaveTables(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+// Saves the routing tables to the file at path after each interval. Does not
+// return, so run as a goroutine.
+func persistTables(path string, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		if err := saveTables(path); err != nil {
+			log.Printf(log.ERROR, "Can't save routing tables to %s: %v\n", path, err)
+		}
+	}
+}
+
+/*
+Reads the routing tables saved in the file at path, to restore them when the
+root mote is known. A missing file is not an error, as on the first run.
+*/
+func restoreTables(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		log.Printf(log.INFO, "No saved routing tables in %s\n", path)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	return router.RestoreTables(file)
+}
@@ -0,0 +1,59 @@
+package main
+
+// Projected routes sent to motes as P-DAOs, on command from the console.
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kb2ma/daghead/internal/log"
+	"github.com/kb2ma/daghead/internal/router"
+)
+
+// Segment Lifetime for a projected route
+var trackLifetime = router.INFINITE_LIFETIME
+
+/*
+Computes a projected route from the ingress to the egress, and sends a P-DAO to
+the ingress to install it as a Track. If disjoint, the route avoids the motes
+along other Tracks between the same motes. Returns the Track.
+*/
+func projectRoute(r *router.Router, ingressId []byte, egressId []byte,
+                  disjoint bool) (*router.ProjectedRoute, error) {
+	track, err := r.ProjectRoute(ingressId, egressId, disjoint, trackLifetime)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("can't project route to [% X]: %v", egressId, err))
+	}
+	err = sendDownstream(r.Key().InstanceId, track.IngressId(), router.IANA_ICMPv6,
+	                     router.EncodePdao(track))
+	if err != nil {
+		r.RemoveTrack(track.TrackId)
+		return nil, errors.New(fmt.Sprintf("can't send P-DAO to [% X]: %v", ingressId, err))
+	}
+	return track, nil
+}
+
+// Removes the Track, and sends a No-Path P-DAO to remove it from the ingress
+func unprojectRoute(r *router.Router, trackId byte) error {
+	track, err := r.RemoveTrack(trackId)
+	if err != nil {
+		return err
+	}
+	err = sendDownstream(r.Key().InstanceId, track.IngressId(), router.IANA_ICMPv6,
+	                     router.EncodePdao(track))
+	if err != nil {
+		return errors.New(fmt.Sprintf("can't send No-Path P-DAO to [% X]: %v",
+		                              track.IngressId(), err))
+	}
+	return nil
+}
+
+// Logs the Tracks for the router, and whether each is active
+func logTracks(r *router.Router) {
+	tracks := r.Tracks()
+	if len(tracks) == 0 {
+		log.Println(log.INFO, "No Tracks")
+	}
+	for _, track := range tracks {
+		log.Printf(log.INFO, "%v, active %v\n", &track, track.Active)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+// Global repair of a DODAG, requested from the root mote on command or on
+// repeated routing loops.
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kb2ma/daghead/internal/log"
+	"github.com/kb2ma/daghead/internal/router"
+	"sync"
+	"time"
+)
+
+const (
+	// Loops detected within the window that trigger a global repair; zero disables
+	DEFAULT_REPAIR_LOOP_LIMIT int = 5
+	DEFAULT_REPAIR_WINDOW = 5 * time.Minute
+)
+
+// Counts loops detected for each DODAG, to trigger a global repair. Safe for use
+// from multiple goroutines.
+type LoopMonitor struct {
+	lock sync.Mutex
+	limit int
+	window time.Duration
+	// times of loops within the window, oldest first
+	loops map[router.DodagKey][]time.Time
+	// time of the last repair, to hold off another until the DAOs rebuild the table
+	repaired map[router.DodagKey]time.Time
+}
+
+var loopMonitor = &LoopMonitor{limit: DEFAULT_REPAIR_LOOP_LIMIT, window: DEFAULT_REPAIR_WINDOW,
+                               loops: make(map[router.DodagKey][]time.Time),
+                               repaired: make(map[router.DodagKey]time.Time)}
+
+/*
+Requests a global repair for the DODAG from the root mote, with the next DODAG
+Version Number, and resets the routing table for the new version.
+*/
+func globalRepair(r *router.Router) error {
+	version := r.NextVersion()
+	content := []byte{SERFRAME_PC2MOTE_GLOBALREPAIR, version}
+	if err := writeFrame(content); err != nil {
+		return errors.New(fmt.Sprintf("can't request global repair: %v", err))
+	}
+	r.GlobalRepair(version)
+	return nil
+}
+
+// Sets the loops within the window that trigger a global repair
+func (m *LoopMonitor) setLimit(limit int, window time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.limit = limit
+	m.window = window
+}
+
+/*
+Handles a routing table event. Triggers a global repair when the loops detected
+for a DODAG reach the limit within the window. Does not repair again within the
+window after a repair, while the DAOs rebuild the table.
+*/
+func (m *LoopMonitor) handleEvent(event router.Event) {
+	switch event.Type {
+	case router.EVENT_GLOBAL_REPAIR:
+		m.lock.Lock()
+		m.repaired[event.Dodag] = time.Now()
+		delete(m.loops, event.Dodag)
+		m.lock.Unlock()
+	case router.EVENT_LOOP_DETECTED:
+		if m.addLoop(event.Dodag, time.Now()) {
+			key := event.Dodag
+			log.Printf(log.WARN, "Repeated loops in instance %d; starting global repair\n",
+			           key.InstanceId)
+			if r := router.FindRouter(key.InstanceId, &key.DodagId); r != nil {
+				if err := globalRepair(r); err != nil {
+					log.Println(log.ERROR, err)
+				}
+			}
+		}
+	}
+}
+
+// Records a loop for the DODAG, and returns true if a global repair is needed
+func (m *LoopMonitor) addLoop(key router.DodagKey, now time.Time) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.limit <= 0 {
+		return false
+	}
+	if last, ok := m.repaired[key]; ok && now.Sub(last) < m.window {
+		return false
+	}
+	loops := m.loops[key]
+	for len(loops) > 0 && now.Sub(loops[0]) >= m.window {
+		loops = loops[1:]
+	}
+	loops = append(loops, now)
+	if len(loops) < m.limit {
+		m.loops[key] = loops
+		return false
+	}
+	delete(m.loops, key)
+	// hold off another repair while this one is requested
+	m.repaired[key] = now
+	return true
+}
@@ -23,6 +23,9 @@ const (
 	HDR_FRAG1   byte = 0xC0
 	HDR_FRAGN   byte = 0xE0
 	HDR_FRAG_MASK byte = 0xF1
+	// RFC 4944 sec. 5.3 fragment header lengths
+	FRAG1_HDR_LEN int = 4
+	FRAGN_HDR_LEN int = 5
 )
 
 type Fragment struct {
@@ -32,6 +35,20 @@ type Fragment struct {
 	contents []byte
 }
 
+// Fragments being reassembled, keyed by datagram tag. Safe for use from multiple
+// goroutines.
+type FragmentTable struct {
+	lock sync.Mutex
+	fragments map[int]*Fragment
+}
+
+// Count of packets rejected for a bad checksum, keyed by source mote EUI-64. Safe
+// for use from multiple goroutines.
+type ChecksumErrors struct {
+	lock sync.Mutex
+	counts map[[8]byte]int
+}
+
 var (
 	// These values really are constants, but a slice can't be a constant.
 	HDLC_FLAG_ARRAY     = []byte{HDLC_FLAG}
@@ -39,7 +56,8 @@ var (
 	HDLC_ESCAPE_ARRAY   = []byte{HDLC_ESCAPE}
 	HDLC_ESCAPE_ESCAPED = []byte{HDLC_ESCAPE, 0x5D}
 
-	fragTable map[int]Fragment
+	fragTable = &FragmentTable{fragments: make(map[int]*Fragment)}
+	checksumErrors = &ChecksumErrors{counts: make(map[[8]byte]int)}
 )
 
 const NOTIFICATION_ERROR int = 0
@@ -65,8 +83,58 @@ type Notification struct {
 	Arg2 uint16
 }
 
-func init() {
-	fragTable = make(map[int]Fragment)
+// Stores the first fragment of a datagram, replacing any with the same tag
+func (table *FragmentTable) start(frag *Fragment) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	table.fragments[frag.tag] = frag
+}
+
+/*
+Inserts the contents of a following fragment at offset, in units of 8 bytes.
+Returns the datagram contents when the datagram is complete, and removes it from
+the table. Returns false if the datagram for tag is not found.
+*/
+func (table *FragmentTable) insert(tag int, offset int, contents []byte) ([]byte, bool) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	frag, ok := table.fragments[tag]
+	if !ok {
+		return nil, false
+	}
+	copy(frag.contents[offset*8:], contents)
+	frag.received += len(contents)
+	if frag.received == frag.total {
+		delete(table.fragments, tag)
+		return frag.contents, true
+	}
+	return nil, true
+}
+
+// Returns the count of datagrams being reassembled
+func (table *FragmentTable) Len() int {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	return len(table.fragments)
+}
+
+// Counts a checksum error for the mote, and returns the total for the mote
+func (errs *ChecksumErrors) add(moteId [8]byte) int {
+	errs.lock.Lock()
+	defer errs.lock.Unlock()
+	errs.counts[moteId]++
+	return errs.counts[moteId]
+}
+
+// Returns a copy of the counts of checksum errors, keyed by mote EUI-64
+func (errs *ChecksumErrors) Counts() map[[8]byte]int {
+	errs.lock.Lock()
+	defer errs.lock.Unlock()
+	counts := make(map[[8]byte]int, len(errs.counts))
+	for id, count := range errs.counts {
+		counts[id] = count
+	}
+	return counts
 }
 
 // Handles HDLC escaping
@@ -95,7 +163,7 @@ func readStatusFrame(statusType byte, data []byte) {
 			log.Printf(log.DEBUG, "is sync? %d\n", o.IsSync)
 		}
 	// only needed to initialize router root node
-	} else if (statusType == 1) && (router.RootNode.Id == nil) {
+	} else if (statusType == 1) && (router.RootId() == nil) {
 		buf := bytes.NewBuffer(data)
 		im := &IdManager{}
 		err := struc.Unpack(buf, im)
@@ -122,42 +190,49 @@ func readNotificationFrame(notificationLevel int, data []byte) {
 func readDataFrame(data []byte) {
 	log.Printf(log.DEBUG, "Decoded: [% X]\n", data)
 	log.Printf(log.INFO, "got data; len total %d, payload %d\n", len(data), len(data)-23)
-	if len(data) < 23 {
-		log.Printf(log.ERROR, "Data frame payload length too small %d/n", len(data))
+	if len(data) <= 23 {
+		log.Printf(log.ERROR, "Data frame payload length too small %d\n", len(data))
 		return
 	}
 
 	// skip mote ID [:2], asn [2:7], destination [7:15], source [15:23]
 	i := 23
 	preHop := data[22]
+	linkDest := data[7:15]
+	linkSource := data[15:23]
 
 	// handle fragmentation if present
 	if (data[23] & HDR_FRAG_MASK) == HDR_FRAG1 {
+		if len(data) < 23 + FRAG1_HDR_LEN {
+			log.Printf(log.ERROR, "FRAG1 header truncated, length %d\n", len(data))
+			return
+		}
 		// store first fragment in fragTable
-		total := int(((data[23] & 0x07) << 8) + data[24])
-		tag := int((data[25] << 8) + data[26])
+		total := (int(data[23] & 0x07) << 8) + int(data[24])
+		tag := (int(data[25]) << 8) + int(data[26])
 		received := len(data) - 27
-		frag := Fragment{tag: tag, total: total, received: received,
-			             contents: make([]byte, total)}
+		frag := &Fragment{tag: tag, total: total, received: received,
+			              contents: make([]byte, total)}
 		copy(frag.contents, data[27:])
-		fragTable[tag] = frag
+		fragTable.start(frag)
 		log.Printf(log.DEBUG, "Created fragment %d, received %d of %d\n", tag, received, total)
 		return
 
 	} else if (data[23] & HDR_FRAG_MASK) == HDR_FRAGN {
+		if len(data) < 23 + FRAGN_HDR_LEN {
+			log.Printf(log.ERROR, "FRAGN header truncated, length %d\n", len(data))
+			return
+		}
 		// insert contents of a following fragment
-		total := int(((data[23] & 0x07) << 8) + data[24])
-		tag := int((data[25] << 8) + data[26])
+		total := (int(data[23] & 0x07) << 8) + int(data[24])
+		tag := (int(data[25]) << 8) + int(data[26])
 		offset := int(data[27])
 		received := len(data) - 28
-		if frag,ok := fragTable[tag]; ok {
-			copy(frag.contents[offset*8:], data[28:])
-			frag.received += received
-			if (frag.received == frag.total) {
+		if contents, ok := fragTable.insert(tag, offset, data[28:]); ok {
+			if contents != nil {
 				i = 0
-				data = frag.contents
-				delete(fragTable, tag)
-				log.Printf(log.DEBUG, "Reassembled fragment %d, [% X]\n", tag, frag.contents)
+				data = contents
+				log.Printf(log.DEBUG, "Reassembled fragment %d, [% X]\n", tag, contents)
 			} else {
 				log.Printf(log.DEBUG, "Updated fragment %d, received %d of %d\n",
 				           tag, received, total)
@@ -171,6 +246,8 @@ func readDataFrame(data []byte) {
 
 	hasHopByHopHeader := false
 	ipData := new(router.IpData)
+	copy(ipData.LinkDest[:], linkDest[:])
+	copy(ipData.LinkSource[:], linkSource[:])
 	if err := router.ReadData(ipData, preHop, data[i:]); err != nil {
 		log.Println(log.ERROR, err)
 		return
@@ -184,14 +261,19 @@ func readDataFrame(data []byte) {
 	}
 
 	if ipData.Fields["next_header"] == int(router.IPV6_HEADER) {
-		hopLimit := ipData.Fields["hop_limit"]
+		// A 6LoRH RPI does not carry a hop limit, so only an outer IPHC sets one.
+		hopLimit, hasHopLimit := ipData.Fields["hop_limit"]
 		// Read inner header, expected to be IPHC.
 		// Overwrites values from initial ReadData(), but that's OK except for
-		// hop limit. Note OpenVisualizer works differently. It copies individual
-		// fields after this second ReadData(). It's possible that the approach
-		// here, although simpler, will be problematic in other scenarios.
-		router.ReadData(ipData, preHop, data[i:])
-		if hopLimit != ipData.Fields["hop_limit"] {
+		// hop limit from an outer IPHC. Note OpenVisualizer works differently. It
+		// copies individual fields after this second ReadData(). It's possible that
+		// the approach here, although simpler, will be problematic in other
+		// scenarios.
+		if err := router.ReadData(ipData, preHop, data[i:]); err != nil {
+			log.Println(log.ERROR, err)
+			return
+		}
+		if hasHopLimit {
 			ipData.Fields["hop_limit"] = hopLimit
 		}
 		i += ipData.Fields["payload"]
@@ -205,25 +287,100 @@ func readDataFrame(data []byte) {
 			if (ipData.Fields["hop_flags"] & int(router.RPI_R_FLAG)) == int(router.RPI_R_FLAG) {
 				log.Printf(log.ERROR, "Possible routing loop in packet from [% X]",
 				           ipData.Source)
+				if r := router.FindRouter(instanceId(ipData), nil); r != nil {
+					r.ReportLoop(ipData.Source[8:])
+				}
 			}
+			updateRank(ipData)
 		}
 	}
 
-	if ipData.Fields["next_header"] == int(router.IANA_ICMPv6) {
-		if ipData.Fields["payload_length"] < 5 {
-			log.Printf(log.ERROR, "ICMP payload length too small %d/n",
-			           ipData.Fields["payload_length"])
+	nextHeader := ipData.Fields["next_header"]
+	if (nextHeader == int(router.IANA_ICMPv6)) && (ipData.Fields["payload_length"] < 5) {
+		log.Printf(log.ERROR, "ICMP payload length too small %d\n",
+		           ipData.Fields["payload_length"])
+		return
+	}
+	// also before forwarding, so a corrupted packet is not sent back into the mesh
+	if (nextHeader == int(router.IANA_ICMPv6)) || (nextHeader == int(router.IANA_UDP)) {
+		if !verifyChecksum(ipData, data[i:]) {
 			return
 		}
+	}
 
-		ipData.Fields["icmpv6_type"] = int(data[i])
-		ipData.Fields["icmpv6_code"] = int(data[i+1])
-		ipData.Fields["icmpv6_checksum"] = int(data[i+2])
-		i += 4
-		ipData.Fields["app_payload"] = i
+	// non-storing mode; route traffic between motes back down into the mesh
+	if isForMote(ipData) {
+		// an error for a packet between motes still reports a bad link
+		if (nextHeader == int(router.IANA_ICMPv6)) &&
+		   (data[i] == router.ICMPv6_TYPE_DEST_UNREACHABLE) {
+			if err := router.ReadIcmpv6(ipData, data[i:]); err != nil {
+				log.Println(log.ERROR, err)
+			}
+		}
+		if err := forwardDownstream(ipData, data[i:]); err != nil {
+			log.Printf(log.ERROR, "Can't forward to [% X], %v\n", ipData.Dest, err)
+		}
+		return
+	}
+
+	if nextHeader == int(router.IANA_ICMPv6) {
+		if err := router.ReadIcmpv6(ipData, data[i:]); err != nil {
+			log.Println(log.ERROR, err)
+		}
+		if (ipData.Fields["icmpv6_type"] == int(router.ICMPv6_TYPE_RPL)) &&
+		   (ipData.Fields["icmpv6_code"] == int(router.RPL_CODE_DAO)) {
+			// also sent for a rejected DAO; only this mote's, so a retry for
+			// another mote waits for its interval
+			sendDaoAcks(ipData.Source[8:])
+		}
+
+	} else if nextHeader == int(router.IANA_UDP) {
+		log.Printf(log.INFO, "UDP from [% X], len %d\n", ipData.Source[8:], len(data)-i)
+	}
+}
 
-		router.ReadRpl(&ipData.Source, data[i:])
+/*
+Updates the rank of the mote that forwarded a packet to the root, from the
+SenderRank in the RPI. SenderRank is rewritten at each hop, so it is the rank of
+the link layer source rather than the IPv6 source. A zero rank is not set.
+*/
+func updateRank(ipData *router.IpData) {
+	rank, ok := ipData.Fields["hop_senderRank"]
+	if !ok || (rank == 0) {
+		return
+	}
+	if r := router.FindRouter(instanceId(ipData), nil); r != nil {
+		r.UpdateRank(ipData.LinkSource[:], rank)
+	}
+}
+
+// Returns the RPL Instance ID for a packet, from its RPI
+func instanceId(ipData *router.IpData) byte {
+	if id, ok := ipData.Fields["hop_rplInstanceID"]; ok {
+		return byte(id)
+	}
+	return router.DEFAULT_INSTANCE_ID
+}
+
+// Verifies the checksum for an upper layer message, and counts a failure
+// against the source mote. Accepts a UDP checksum elided by NHC without
+// verifying it, since it is not a failure.
+func verifyChecksum(ipData *router.IpData, data []byte) bool {
+	err := router.VerifyChecksum(ipData, data)
+	if err == router.ErrChecksumElided {
+		log.Printf(log.DEBUG, "Accepted packet from [% X] without verifying; %v\n",
+		           ipData.Source[8:], err)
+		return true
+	}
+	if err != nil {
+		var moteId [8]byte
+		copy(moteId[:], ipData.Source[8:])
+		count := checksumErrors.add(moteId)
+		log.Printf(log.ERROR, "Rejected packet from [% X], %v; total rejected %d\n",
+		           moteId, err, count)
+		return false
 	}
+	return true
 }
 
 /*
@@ -0,0 +1,144 @@
+package main
+
+import (
+  "bytes"
+  "testing"
+  "github.com/kb2ma/daghead/internal/router"
+  "github.com/stretchr/testify/assert"
+)
+
+var (
+	rootId = [8]byte{0x46, 0x1D, 0x52, 0x44, 0x7B, 0x43, 0x76, 0x78}
+	moteA = []byte{0x82, 0x54, 0x7D, 0x13, 0x76, 0x65, 0x79, 0x78}
+	moteB = []byte{0x82, 0x54, 0x7D, 0x13, 0x76, 0x65, 0x79, 0x79}
+	moteC = []byte{0x82, 0x54, 0x7D, 0x13, 0x76, 0x65, 0x79, 0x7A}
+)
+
+// Returns a data frame from the root mote, received from moteA, for the IPHC
+// encoded packet in iphc, after a 6LoRH RPI
+func dataFrame(iphc []byte) []byte {
+	// mote ID, ASN, link destination (root) and source (moteA)
+	frame := []byte{0x00, 0x01, 0, 0, 0, 0, 0}
+	frame = append(frame, rootId[:]...)
+	frame = append(frame, moteA...)
+	// 6LoRH RPI, instance elided, one byte rank
+	frame = append(frame, router.PAGE_ONE_DISPATCH, 0x83, 0x05, 0x0B)
+	return append(frame, iphc...)
+}
+
+/*
+Returns a data frame from the root mote for a UDP datagram from moteB to moteA,
+with a 6LoRH RPI and an IPHC header with hop limit 64, and a UDP header
+compressed with NHC. Also returns the UDP datagram with an uncompressed header.
+*/
+func moteToMoteFrame() ([]byte, []byte) {
+	source := router.NodeAddress(moteB)
+	dest := router.NodeAddress(moteA)
+	udp := []byte{0xF0, 0xB1, 0x16, 0x33, 0x00, 0x0C, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03}
+	router.SetChecksum(&source, &dest, router.IANA_UDP, udp)
+
+	// IPHC, hop limit 64, addresses from context 0, NHC UDP with ports and checksum
+	iphc := []byte{0x7E, 0x55}
+	iphc = append(iphc, moteB...)
+	iphc = append(iphc, moteA...)
+	iphc = append(iphc, 0xF0)
+	iphc = append(iphc, udp[0:4]...)
+	iphc = append(iphc, udp[6:]...)
+	return dataFrame(iphc), udp
+}
+
+// Sets up a routing table with moteA and moteC below the root and moteB below
+// moteA, and captures frames written to the root mote.
+func initForwarding() *bytes.Buffer {
+	router.InitRootNode(rootId)
+	router.SetStaticLinks(append(router.StaticPath([][]byte{nil, moteA, moteB}),
+	                             router.StaticLink{ChildId: moteC}))
+	written := new(bytes.Buffer)
+	rootPort = written
+	return written
+}
+
+// Tests forwarding a UDP datagram between motes back down into the mesh, with the
+// hop limit decremented
+func TestForwardDownstream(t *testing.T) {
+	written := initForwarding()
+	defer func() {
+		rootPort = nil
+		router.SetStaticLinks(nil)
+	}()
+	frame, udp := moteToMoteFrame()
+	readDataFrame(frame)
+
+	pkt := &router.DownstreamPacket{Source: router.NodeAddress(moteB),
+	                                Dest: router.NodeAddress(moteA),
+	                                NextHeader: router.IANA_UDP, HopLimit: 63,
+	                                SenderRank: router.ROOT_RANK, Payload: udp}
+	nextHop, lowpan, err := router.EncodeDownstream([][]byte{rootId[:], moteA}, pkt)
+	assert.Nil(t, err)
+	assert.True(t, bytes.Contains(lowpan, router.EncodeIphc(&pkt.Source, &pkt.Dest,
+	                                                         router.IANA_UDP, 63)))
+	content := append(append([]byte{SERFRAME_PC2MOTE_DATA}, nextHop...), lowpan...)
+	assert.Equal(t, encodeHdlc(content), written.Bytes())
+}
+
+// Tests that a data frame truncated at or within a fragment header is dropped
+// rather than panic
+func TestTruncatedFrame(t *testing.T) {
+	header := make([]byte, 23)
+	readDataFrame(header)
+	readDataFrame(append(append([]byte{}, header...), HDR_FRAG1, 0x40, 0x12))
+	readDataFrame(append(append([]byte{}, header...), HDR_FRAGN, 0x40, 0x12, 0x34))
+}
+
+// Tests that a packet between motes with a bad checksum is not forwarded, and is
+// counted against its source
+func TestForwardBadChecksum(t *testing.T) {
+	written := initForwarding()
+	defer func() {
+		rootPort = nil
+		router.SetStaticLinks(nil)
+	}()
+	var sourceId [8]byte
+	copy(sourceId[:], moteB)
+	count := checksumErrors.Counts()[sourceId]
+
+	frame, _ := moteToMoteFrame()
+	frame[len(frame)-1] ^= 0x01
+	readDataFrame(frame)
+	assert.Equal(t, 0, written.Len())
+	assert.Equal(t, count + 1, checksumErrors.Counts()[sourceId])
+}
+
+/*
+Tests that a Destination Unreachable from moteA, for a packet from moteC to
+moteB, reports an error for the link from moteA to moteB as it is forwarded to
+moteC.
+*/
+func TestForwardLinkError(t *testing.T) {
+	written := initForwarding()
+	defer func() {
+		rootPort = nil
+		router.SetStaticLinks(nil)
+	}()
+	source := router.NodeAddress(moteA)
+	dest := router.NodeAddress(moteC)
+	// SRH error, unused field, then the invoking packet's IPv6 header
+	msg := make([]byte, 48)
+	msg[0] = router.ICMPv6_TYPE_DEST_UNREACHABLE
+	msg[1] = router.ICMPv6_CODE_SRH_ERROR
+	msg[8] = 0x60
+	invokingDest := router.NodeAddress(moteB)
+	copy(msg[32:], invokingDest[:])
+	router.SetChecksum(&source, &dest, router.IANA_ICMPv6, msg)
+
+	// IPHC, hop limit 64, ICMPv6 inline, addresses from context 0
+	iphc := []byte{0x7A, 0x55, router.IANA_ICMPv6}
+	iphc = append(iphc, moteA...)
+	iphc = append(iphc, moteC...)
+	readDataFrame(dataFrame(append(iphc, msg...)))
+
+	link := router.DefaultRouter().Snapshot().Node(moteB).Parents[0]
+	assert.Equal(t, 1, link.ErrorCount)
+	assert.True(t, link.Suspect)
+	assert.True(t, written.Len() > 0)
+}
@@ -0,0 +1,221 @@
+package main
+
+// Functions and data around writing frames to the serial port of the root mote.
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kb2ma/daghead/internal/log"
+	"github.com/kb2ma/daghead/internal/router"
+	"github.com/snksoft/crc"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	SERFRAME_PC2MOTE_DATA       byte = 'D'
+	SERFRAME_PC2MOTE_SETDAGROOT byte = 'R'
+	SERFRAME_ACTION_TOGGLE      byte = 'T'
+	// Sets the DODAG Version Number for a global repair; see README-openwsn.md
+	SERFRAME_PC2MOTE_GLOBALREPAIR byte = 'V'
+	// hop limit for packets sent from the root
+	DEFAULT_HOP_LIMIT int = 64
+	// time between attempts to send an outstanding DAO-ACK
+	DEFAULT_DAO_ACK_INTERVAL = 10 * time.Second
+)
+
+var (
+	// Serial port to the root mote; writes must hold writeLock so frames from
+	// separate goroutines are not interleaved.
+	rootPort io.Writer
+	writeLock sync.Mutex
+)
+
+/*
+Encodes a frame for the root mote. Appends the CRC, escapes 0x7E and 0x7D bytes,
+and adds the start and end flags.
+
+Follows OpenVisualizer, which does not escape XON/XOFF bytes for the mote.
+*/
+func encodeHdlc(content []byte) []byte {
+	hash := crc.CalculateCRC(crc.X25, content)
+	raw := append(append([]byte{}, content...), byte(hash & 0xFF), byte((hash & 0xFF00) >> 8))
+
+	frame := make([]byte, 0, len(raw) + 4)
+	frame = append(frame, HDLC_FLAG)
+	for _, b := range raw {
+		switch b {
+		case HDLC_FLAG:
+			frame = append(frame, HDLC_FLAG_ESCAPED...)
+		case HDLC_ESCAPE:
+			frame = append(frame, HDLC_ESCAPE_ESCAPED...)
+		default:
+			frame = append(frame, b)
+		}
+	}
+	return append(frame, HDLC_FLAG)
+}
+
+// Writes a frame with the provided content to the root mote
+func writeFrame(content []byte) error {
+	if rootPort == nil {
+		return errors.New("serial port to root mote not open")
+	}
+	frame := encodeHdlc(content)
+	log.Printf(log.DEBUG, "write frame [% X]\n", frame)
+
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	_, err := rootPort.Write(frame)
+	return err
+}
+
+/*
+Sends a packet from the root to the mote with destId, in the RPL Instance. The
+payload is the upper layer message; sets its checksum.
+*/
+func sendDownstream(instanceId byte, destId []byte, nextHeader byte, payload []byte) error {
+	return sendDownstreamRoute(instanceId, destId, nextHeader, payload, nil)
+}
+
+/*
+Sends a packet from the root to the mote with destId along route, as for a mote
+not in the routing table. Uses the routing table if route is nil. Otherwise the
+same as sendDownstream().
+*/
+func sendDownstreamRoute(instanceId byte, destId []byte, nextHeader byte, payload []byte,
+                         route [][]byte) error {
+	rootId := router.RootId()
+	if rootId == nil {
+		return router.ErrNoRoot
+	}
+	pkt := &router.DownstreamPacket{Source: router.NodeAddress(rootId),
+	                                Dest: router.NodeAddress(destId), NextHeader: nextHeader,
+	                                HopLimit: DEFAULT_HOP_LIMIT, InstanceId: instanceId,
+	                                SenderRank: router.ROOT_RANK, Payload: payload}
+	if err := router.SetChecksum(&pkt.Source, &pkt.Dest, nextHeader, payload); err != nil {
+		return err
+	}
+	if route == nil {
+		return sendPacket(pkt)
+	}
+	return sendRoutedPacket(pkt, route)
+}
+
+/*
+Forwards a packet from one mote to another mote, or to a prefix the other mote
+advertises. In non-storing mode, the packet climbs to the root, so daghead must
+send it back down with a source route. Decrements the hop limit, and drops the
+packet if the limit is exhausted. The payload is the upper layer message
+following the IP header described by ipData; its checksum must be verified
+already.
+*/
+func forwardDownstream(ipData *router.IpData, payload []byte) error {
+	hopLimit := ipData.Fields["hop_limit"] - 1
+	if hopLimit <= 0 {
+		return errors.New(fmt.Sprintf("hop limit exhausted from [% X]", ipData.Source[8:]))
+	}
+	nextHeader := byte(ipData.Fields["next_header"])
+	pkt := &router.DownstreamPacket{Source: ipData.Source, Dest: ipData.Dest,
+	                                NextHeader: nextHeader, HopLimit: hopLimit,
+	                                InstanceId: instanceId(ipData),
+	                                SenderRank: router.ROOT_RANK, Payload: payload}
+
+	// Expand a UDP header compressed with NHC, since the packet is re-encoded with
+	// the next header inline. An elided checksum must be generated, as by any
+	// decompressor, RFC 6282 sec. 4.3.2; there is no checksum to verify first.
+	if _, ok := ipData.Fields["udp_src_port"]; ok && (nextHeader == router.IANA_UDP) {
+		pkt.Payload = append(router.UdpHeader(ipData, len(payload)), payload...)
+		if ipData.Fields["udp_checksum_elided"] == 1 {
+			if err := router.SetChecksum(&pkt.Source, &pkt.Dest, nextHeader,
+			                             pkt.Payload); err != nil {
+				return err
+			}
+		}
+	}
+	return sendPacket(pkt)
+}
+
+/*
+Sends a packet into the mesh. Looks up the source route to the mote that reaches
+the destination in the packet's RPL Instance, and sends the 6LoWPAN encoded
+packet to the root mote as a data frame, addressed to the first hop.
+*/
+func sendPacket(pkt *router.DownstreamPacket) error {
+	r := router.FindRouter(pkt.InstanceId, nil)
+	if r == nil {
+		return errors.New(fmt.Sprintf("no router for instance %d", pkt.InstanceId))
+	}
+	route, err := r.SourceRouteForAddress(&pkt.Dest)
+	if err != nil {
+		return errors.New(fmt.Sprintf("no route to [% X]: %v", pkt.Dest, err))
+	}
+	return sendRoutedPacket(pkt, route)
+}
+
+// Sends a packet into the mesh along the source route, from the root to the last hop
+func sendRoutedPacket(pkt *router.DownstreamPacket, route [][]byte) error {
+	nextHop, lowpan, err := router.EncodeDownstream(route, pkt)
+	if err != nil {
+		return err
+	}
+	log.Printf(log.INFO, "send to [% X] via [% X], %d hops\n", pkt.Dest, nextHop,
+	           len(route)-1)
+
+	content := make([]byte, 0, 9 + len(lowpan))
+	content = append(content, SERFRAME_PC2MOTE_DATA)
+	content = append(content, nextHop...)
+	content = append(content, lowpan...)
+	return writeFrame(content)
+}
+
+/*
+Sends the outstanding DAO-ACKs for the mote with destId, or for all motes if
+destId is nil. A DAO-ACK that can't be sent, as when the route to the mote
+still is pending, stays outstanding for retryDaoAcks(), up to the limit on
+attempts. A DAO-ACK for a rejected DAO uses its own route, since the mote is
+not in the routing table. Skips a DAO-ACK another goroutine has taken to send.
+*/
+func sendDaoAcks(destId []byte) {
+	for _, ack := range router.TakeAcks(destId) {
+		r := router.FindRouter(ack.Dodag.InstanceId, &ack.Dodag.DodagId)
+		if r == nil {
+			continue
+		}
+		err := sendDownstreamRoute(ack.Dodag.InstanceId, ack.DestId, router.IANA_ICMPv6,
+		                           router.EncodeDaoAck(&ack), ack.Route)
+		if err != nil {
+			log.Printf(log.WARN, "Can't send DAO-ACK to [% X], %v\n", ack.DestId, err)
+			r.AckFailed(ack.DestId, ack.Sequence)
+		} else {
+			r.AckSent(ack.DestId, ack.Sequence)
+		}
+	}
+}
+
+// Retries the outstanding DAO-ACKs after each interval. Does not return, so run
+// as a goroutine.
+func retryDaoAcks(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		sendDaoAcks(nil)
+	}
+}
+
+/*
+Returns true if the packet is addressed to a mote in the mesh other than the
+root, or to a prefix advertised by a mote, in the packet's RPL Instance.
+*/
+func isForMote(ipData *router.IpData) bool {
+	rootId := router.RootId()
+	if (rootId == nil) || (ipData.Dest == router.NodeAddress(rootId)) {
+		return false
+	}
+	r := router.FindRouter(instanceId(ipData), nil)
+	if r == nil {
+		return false
+	}
+	_, err := r.SourceRouteForAddress(&ipData.Dest)
+	return err != router.ErrUnknownDestination
+}